@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// builtinTool is a tool the proxy runs itself instead of returning the call
+// to the client
+type builtinTool struct {
+	description string
+	parameters  map[string]interface{}
+	run         func(arguments string) (string, error)
+}
+
+// builtinToolRegistry holds the tools BUILTIN_TOOLS can enable
+var builtinToolRegistry = map[string]builtinTool{
+	"datetime": {
+		description: "Returns the current date and time, in UTC or in the given IANA time zone.",
+		parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"timezone": map[string]string{"type": "string", "description": "IANA time zone such as Europe/Paris"},
+			},
+		},
+		run: runDatetimeTool,
+	},
+	"calculator": {
+		description: "Evaluates an arithmetic expression with + - * / % ^ and parentheses.",
+		parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"expression": map[string]string{"type": "string", "description": "Expression such as (2 + 3) * 4"},
+			},
+			"required": []string{"expression"},
+		},
+		run: runCalculatorTool,
+	},
+}
+
+var (
+	// Tools run by the proxy (BUILTIN_TOOLS), by name
+	builtinTools map[string]builtinTool
+
+	// Consecutive tool call rounds allowed, counting those already in the
+	// conversation and the builtin ones (MAX_TOOL_ROUNDS)
+	maxToolRounds = 10
+)
+
+var errMaxToolRounds = errors.New("exceeded maximum tool call rounds")
+
+// conversationToolRounds counts the assistant tool call messages at the end
+// of messages, not followed by any answer or user message
+func conversationToolRounds(messages []Message) int {
+	rounds := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		switch {
+		case messages[i].Role == "tool":
+		case messages[i].Role == "assistant" && len(messages[i].ToolCalls) > 0:
+			rounds++
+		default:
+			return rounds
+		}
+	}
+	return rounds
+}
+
+// parseBuiltinTools returns the registry entries named in the comma-separated
+// value
+func parseBuiltinTools(value string) (map[string]builtinTool, error) {
+	tools := make(map[string]builtinTool)
+	for _, name := range splitList(value) {
+		tool, ok := builtinToolRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tool %q, expected datetime or calculator", name)
+		}
+		tools[name] = tool
+	}
+	return tools, nil
+}
+
+// sendWithBuiltinTools sends openRouterReq like sendWithRetries, but first
+// offers the builtin tools the client did not define itself. While the model
+// only calls builtin tools, they are run and their results sent back; once
+// the conversation has more than MAX_TOOL_ROUNDS tool call rounds it fails
+// with errMaxToolRounds. The rounds are made without streaming; the final
+// completion is replayed as a stream when the client asked for one.
+func sendWithBuiltinTools(r *http.Request, upstream Config, openRouterReq OpenRouterRequest) (*http.Response, error) {
+	if len(builtinTools) == 0 || bytes.Equal(openRouterReq.ToolChoice, toolChoiceNone) {
+		return sendWithRetries(r, upstream, openRouterReq)
+	}
+	if capabilities, ok := capabilitiesFor(openRouterReq.Model); ok && !capabilities.Tools {
+		return sendWithRetries(r, upstream, openRouterReq)
+	}
+
+	tools := make(map[string]builtinTool, len(builtinTools))
+	for name, tool := range builtinTools {
+		tools[name] = tool
+	}
+	for _, tool := range openRouterReq.Tools {
+		delete(tools, tool.Function.Name)
+	}
+	if len(tools) == 0 {
+		return sendWithRetries(r, upstream, openRouterReq)
+	}
+
+	req := openRouterReq
+	req.Stream = false
+	req.StreamOptions = nil
+	req.Tools = append([]Tool(nil), openRouterReq.Tools...)
+	names := make([]string, 0, len(tools))
+	for name := range tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tool := tools[name]
+		req.Tools = append(req.Tools, Tool{
+			Type:     "function",
+			Function: Function{Name: name, Description: tool.description, Parameters: tool.parameters},
+		})
+	}
+	req.Messages = append([]Message(nil), openRouterReq.Messages...)
+
+	rounds := conversationToolRounds(req.Messages)
+	for {
+		resp, err := sendWithRetries(r, upstream, req)
+		if err != nil || resp.StatusCode >= 400 {
+			return resp, err
+		}
+		body, err := readResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading tool round response: %w", err)
+		}
+
+		message, ok := builtinToolCallMessage(body, tools)
+		if !ok {
+			return completionResponse(resp, body, openRouterReq.Stream)
+		}
+		if rounds++; rounds > maxToolRounds {
+			return nil, errMaxToolRounds
+		}
+
+		req.Messages = append(req.Messages, message)
+		for _, call := range message.ToolCalls {
+			result, err := tools[call.Function.Name].run(call.Function.Arguments)
+			if err != nil {
+				result = "error: " + err.Error()
+			}
+			reqDebugLog(r.Context(), "Builtin tool %s(%s) returned %s", call.Function.Name, call.Function.Arguments, result)
+			req.Messages = append(req.Messages, Message{Role: "tool", ToolCallID: call.ID, Name: call.Function.Name, Content: ContentField{Text: result}})
+		}
+		reqLog(r.Context(), "Ran %d builtin tool calls, sending round %d", len(message.ToolCalls), rounds)
+	}
+}
+
+// builtinToolCallMessage returns the assistant message of a completion when
+// every tool call it makes is one of tools
+func builtinToolCallMessage(body []byte, tools map[string]builtinTool) (Message, bool) {
+	var completion struct {
+		Choices []struct {
+			Message Message `json:"message"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(body, &completion) != nil || len(completion.Choices) == 0 {
+		return Message{}, false
+	}
+	message := completion.Choices[0].Message
+	if len(message.ToolCalls) == 0 {
+		return Message{}, false
+	}
+	for _, call := range message.ToolCalls {
+		if _, ok := tools[call.Function.Name]; !ok {
+			return Message{}, false
+		}
+	}
+	return message, true
+}
+
+// completionResponse wraps a completion already read from resp in a new
+// response, rendered as a single SSE chunk when stream is set
+func completionResponse(resp *http.Response, body []byte, stream bool) (*http.Response, error) {
+	final := *resp
+	final.Header = resp.Header.Clone()
+	final.Header.Del("Content-Encoding")
+	final.Header.Del("Content-Length")
+	if stream {
+		chunk, err := completionChunk(body)
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(fmt.Sprintf("data: %s\n\n%s", chunk, doneSentinel))
+		final.Header.Set("Content-Type", "text/event-stream")
+	}
+	final.Body = io.NopCloser(bytes.NewReader(body))
+	final.ContentLength = int64(len(body))
+	return &final, nil
+}
+
+// completionChunk turns a chat completion into a chat.completion.chunk
+// carrying each message as a delta. Tool call deltas need their index.
+func completionChunk(body []byte) ([]byte, error) {
+	var completion map[string]json.RawMessage
+	if err := json.Unmarshal(body, &completion); err != nil {
+		return nil, fmt.Errorf("parsing completion: %w", err)
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(completion["choices"], &choices); err != nil {
+		return nil, fmt.Errorf("parsing completion choices: %w", err)
+	}
+	for _, choice := range choices {
+		var message map[string]json.RawMessage
+		if err := json.Unmarshal(choice["message"], &message); err != nil {
+			return nil, fmt.Errorf("parsing completion message: %w", err)
+		}
+		if raw, ok := message["tool_calls"]; ok {
+			var calls []map[string]interface{}
+			if err := json.Unmarshal(raw, &calls); err != nil {
+				return nil, fmt.Errorf("parsing tool calls: %w", err)
+			}
+			for i, call := range calls {
+				call["index"] = i
+			}
+			message["tool_calls"], _ = json.Marshal(calls)
+		}
+		choice["delta"], _ = json.Marshal(message)
+		delete(choice, "message")
+	}
+	completion["choices"], _ = json.Marshal(choices)
+	completion["object"] = json.RawMessage(`"chat.completion.chunk"`)
+	return json.Marshal(completion)
+}
+
+func runDatetimeTool(arguments string) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if strings.TrimSpace(arguments) != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %v", err)
+		}
+	}
+	location := time.UTC
+	if args.Timezone != "" {
+		loaded, err := time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("unknown time zone %q", args.Timezone)
+		}
+		location = loaded
+	}
+	now := time.Now().In(location)
+	result, _ := json.Marshal(map[string]interface{}{
+		"datetime": now.Format(time.RFC3339),
+		"weekday":  now.Weekday().String(),
+		"timezone": location.String(),
+		"unix":     now.Unix(),
+	})
+	return string(result), nil
+}
+
+func runCalculatorTool(arguments string) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("invalid arguments: %v", err)
+	}
+	value, err := evaluateExpression(args.Expression)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64), nil
+}
+
+// expressionParser is a recursive descent parser over an arithmetic
+// expression:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/" | "%") unary }
+//	unary  = ("-" | "+") unary | power
+//	power  = factor [ "^" unary ]
+//	factor = number | "(" expr ")"
+type expressionParser struct {
+	input string
+	pos   int
+}
+
+// evaluateExpression computes the value of an arithmetic expression
+func evaluateExpression(expression string) (float64, error) {
+	p := &expressionParser{input: expression}
+	value, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("result is not a finite number")
+	}
+	return value, nil
+}
+
+func (p *expressionParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// accept consumes op when it is the next character
+func (p *expressionParser) accept(op byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *expressionParser) expr() (float64, error) {
+	value, err := p.term()
+	for err == nil {
+		var rhs float64
+		switch {
+		case p.accept('+'):
+			rhs, err = p.term()
+			value += rhs
+		case p.accept('-'):
+			rhs, err = p.term()
+			value -= rhs
+		default:
+			return value, nil
+		}
+	}
+	return 0, err
+}
+
+func (p *expressionParser) term() (float64, error) {
+	value, err := p.unary()
+	for err == nil {
+		var rhs float64
+		switch {
+		case p.accept('*'):
+			rhs, err = p.unary()
+			value *= rhs
+		case p.accept('/'):
+			if rhs, err = p.unary(); err == nil && rhs == 0 {
+				err = fmt.Errorf("division by zero")
+			}
+			value /= rhs
+		case p.accept('%'):
+			if rhs, err = p.unary(); err == nil && rhs == 0 {
+				err = fmt.Errorf("division by zero")
+			}
+			value = math.Mod(value, rhs)
+		default:
+			return value, nil
+		}
+	}
+	return 0, err
+}
+
+func (p *expressionParser) unary() (float64, error) {
+	switch {
+	case p.accept('-'):
+		value, err := p.unary()
+		return -value, err
+	case p.accept('+'):
+		return p.unary()
+	}
+	return p.power()
+}
+
+// power is right associative: 2^3^2 is 2^9
+func (p *expressionParser) power() (float64, error) {
+	base, err := p.factor()
+	if err != nil || !p.accept('^') {
+		return base, err
+	}
+	exponent, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *expressionParser) factor() (float64, error) {
+	if p.accept('(') {
+		value, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, fmt.Errorf("missing closing parenthesis")
+		}
+		return value, nil
+	}
+
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.input) {
+			return 0, fmt.Errorf("unexpected end of expression")
+		}
+		return 0, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", p.input[start:p.pos])
+	}
+	return value, nil
+}
@@ -0,0 +1,298 @@
+// Command replay sends the requests recorded in a RECORD_FILE to a proxy and
+// reports the responses that differ from the recorded ones.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Recording mirrors the lines written by the proxy to RECORD_FILE
+type Recording struct {
+	Timestamp string `json:"timestamp"`
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Model     string `json:"model"`
+	Request   string `json:"request"`
+	Status    int    `json:"status"`
+	Response  string `json:"response"`
+}
+
+func main() {
+	target := flag.String("target", "http://127.0.0.1:9000", "base URL of the proxy to replay against")
+	apiKey := flag.String("api-key", os.Getenv("REPLAY_API_KEY"), "bearer token sent with each request (default $REPLAY_API_KEY)")
+	ignoreFields := flag.String("ignore-fields", "id,created", "comma-separated JSON fields left out of the comparison; dotted paths (usage.total_tokens) reach nested fields")
+	filterModel := flag.String("filter-model", "", "only replay requests served by this model")
+	timeout := flag.Duration("timeout", 2*time.Minute, "timeout of each replayed request")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: replay [flags] RECORD_FILE\n\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "Replays the chat completions recorded by the proxy (RECORD_FILE) against\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "-target and prints a unified diff on stderr for every response whose status\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "or body differs. Exits with status 1 when any response differs.\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	recordings, err := readRecordings(flag.Arg(0), *filterModel)
+	if err != nil {
+		log.Fatalf("Error reading recordings: %v", err)
+	}
+
+	var ignored []string
+	for _, field := range strings.Split(*ignoreFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignored = append(ignored, field)
+		}
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	replayed, differing := 0, 0
+	for _, recording := range recordings {
+		status, body, err := replay(client, *target, *apiKey, recording)
+		replayed++
+		if err != nil {
+			differing++
+			fmt.Fprintf(os.Stderr, "%s: %v\n", recording.RequestID, err)
+			continue
+		}
+		expected := fmt.Sprintf("status: %d\n%s", recording.Status, normalize(recording.Response, ignored))
+		actual := fmt.Sprintf("status: %d\n%s", status, normalize(body, ignored))
+		if expected != actual {
+			differing++
+			fmt.Fprint(os.Stderr, unifiedDiff("recorded/"+recording.RequestID, "replayed/"+recording.RequestID, expected, actual))
+		}
+	}
+
+	fmt.Printf("Replayed %d requests, %d differ\n", replayed, differing)
+	if differing > 0 {
+		os.Exit(1)
+	}
+}
+
+// readRecordings loads the whole file before anything is replayed, so a
+// target that records to the same file does not feed the replay its own
+// requests
+func readRecordings(path, model string) ([]Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var recordings []Recording
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var recording Recording
+		if err := json.Unmarshal(scanner.Bytes(), &recording); err != nil {
+			log.Printf("Warning: skipping invalid recording: %v", err)
+			continue
+		}
+		if model != "" && recording.Model != model {
+			continue
+		}
+		recordings = append(recordings, recording)
+	}
+	return recordings, scanner.Err()
+}
+
+// replay sends one recorded request to target
+func replay(client *http.Client, target, apiKey string, recording Recording) (int, string, error) {
+	req, err := http.NewRequest(recording.Method, strings.TrimSuffix(target, "/")+recording.Path, strings.NewReader(recording.Request))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return resp.StatusCode, string(body), nil
+}
+
+// normalize pretty-prints a JSON body without the ignored fields so diffs
+// are line based. Streamed bodies are normalized event by event.
+func normalize(body string, ignored []string) string {
+	if value, ok := normalizeJSON([]byte(body), ignored); ok {
+		return value
+	}
+
+	var out strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			if value, ok := normalizeJSON([]byte(strings.TrimPrefix(line, "data: ")), ignored); ok {
+				out.WriteString("data: " + value)
+				continue
+			}
+		}
+		if line != "" {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.String()
+}
+
+func normalizeJSON(data []byte, ignored []string) (string, bool) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", false
+	}
+	for _, field := range ignored {
+		deleteField(value, strings.Split(field, "."))
+	}
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+	return out.String(), true
+}
+
+// deleteField removes a dotted path from decoded JSON. Arrays apply the rest
+// of the path to each element.
+func deleteField(value interface{}, path []string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+			return
+		}
+		deleteField(v[path[0]], path[1:])
+	case []interface{}:
+		for _, item := range v {
+			deleteField(item, path)
+		}
+	}
+}
+
+// unifiedDiff returns a unified diff of two texts with three lines of
+// context, or an empty string when they are equal
+func unifiedDiff(fromName, toName, from, to string) string {
+	a := strings.SplitAfter(from, "\n")
+	b := strings.SplitAfter(to, "\n")
+
+	// Longest common subsequence table, filled from the end
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Edit script: ' ' keeps, '-' removes from a, '+' adds from b
+	type edit struct {
+		op   byte
+		line string
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	for start := 0; start < len(edits); {
+		// Find the next change and the end of its hunk
+		first := start
+		for first < len(edits) && edits[first].op == ' ' {
+			first++
+		}
+		if first == len(edits) {
+			break
+		}
+		last := first
+		for k := first; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				last = k
+			} else if k-last > 2*context {
+				break
+			}
+		}
+		from, to := first-context, last+context+1
+		if from < start {
+			from = start
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		// Line numbers of the hunk in both texts
+		aLine, bLine := 1, 1
+		for _, e := range edits[:from] {
+			if e.op != '+' {
+				aLine++
+			}
+			if e.op != '-' {
+				bLine++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aLine, aCount, bLine, bCount)
+		for _, e := range edits[from:to] {
+			line := e.line
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n\\ No newline at end of file\n"
+			}
+			out.WriteString(string(e.op) + line)
+		}
+		start = to
+	}
+	return out.String()
+}
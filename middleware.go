@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+)
+
+// Middleware wraps a handler with one request handling concern
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps handler with middlewares, the first one outermost: it sees
+// the request first and the response last
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// requiresAPIKey reports whether r goes to the proxied API, which needs a
+// client API key, rather than to an admin, probe or documentation endpoint
+func requiresAPIKey(r *http.Request) bool {
+	if _, ok := adminRoutes[r.Method+" "+r.URL.Path]; ok {
+		return false
+	}
+	return strings.HasPrefix(r.URL.Path, "/v1/")
+}
+
+// bearerKey returns the API key of the Authorization header, if any
+func bearerKey(r *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// RecoveryMiddleware turns a handler panic into a 500 response instead of a
+// dropped connection, logging the stack
+func RecoveryMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := &statusRecorder{ResponseWriter: w}
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				reqLog(r.Context(), "Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				if recorder.status == 0 {
+					writeError(recorder, http.StatusInternalServerError, errTypeServer, "Internal server error")
+				}
+			}()
+			next.ServeHTTP(recorder, r)
+		})
+	}
+}
+
+// RequestIDMiddleware makes sure every request has an X-Request-ID
+func RequestIDMiddleware() Middleware {
+	return requestIDMiddleware
+}
+
+// LoggingMiddleware logs a summary line per request and records its metrics
+func LoggingMiddleware() Middleware {
+	return loggingMiddleware
+}
+
+// CORSMiddleware adds the CORS headers to every response and answers
+// preflight requests
+func CORSMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			enableCors(w)
+			if r.Method == http.MethodOptions {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimitMiddleware applies the request budget of the client key. Requests
+// without a well-formed key are left to AuthMiddleware.
+func RateLimitMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := bearerKey(r)
+			if !requiresAPIKey(r) || !strings.HasPrefix(key, "sk-") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if limiter := limiterFor(key); limiter != nil {
+				if !limiter.Allow() {
+					reqLog(r.Context(), "Rate limit exceeded for key %s", maskAPIKey(key))
+					writeError(w, http.StatusTooManyRequests, errTypeRateLimit, "Rate limit exceeded")
+					return
+				}
+				w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(limiter.Tokens())))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// AuthMiddleware checks the client API key of proxied API requests. Only
+// the format is checked (sk-*); Anthropic keys (sk-ant-*) are opt-in.
+func AuthMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !requiresAPIKey(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				reqDebugLog(r.Context(), "Missing or invalid Authorization header")
+				writeError(w, http.StatusUnauthorized, errTypeAuthentication, "Missing or invalid Authorization header")
+				return
+			}
+			key := bearerKey(r)
+			if !strings.HasPrefix(key, "sk-") {
+				reqLog(r.Context(), "Invalid API key format")
+				writeError(w, http.StatusUnauthorized, errTypeAuthentication, "Invalid API key format")
+				return
+			}
+			if strings.HasPrefix(key, "sk-ant-") && !allowAnthropicKeys {
+				reqLog(r.Context(), "Rejected Anthropic-format API key")
+				writeError(w, http.StatusUnauthorized, errTypeAuthentication, "Anthropic API keys are not accepted (set ALLOW_ANTHROPIC_KEYS=true)")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireJSON rejects POST requests to the /v1/ endpoints with 415 unless
+// their body is declared as JSON, before it is read. /v1/echo accepts any
+// body.
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/v1/") && r.URL.Path != "/v1/echo" {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				reqLog(r.Context(), "Rejected request to %s with Content-Type %q", r.URL.Path, r.Header.Get("Content-Type"))
+				writeError(w, http.StatusUnsupportedMediaType, errTypeInvalidRequest, "Content-Type must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// VersionMiddleware adds an X-Proxy-Version header with the build version to
+// every successful response, so canary deployments can tell which build
+// answered
+func VersionMiddleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&versionWriter{&statusRecorder{ResponseWriter: w}}, r)
+		})
+	}
+}
+
+// versionWriter sets X-Proxy-Version when the response status is written,
+// unless it is an error
+type versionWriter struct {
+	*statusRecorder
+}
+
+func (v *versionWriter) WriteHeader(code int) {
+	if v.status == 0 && code < 400 {
+		v.Header().Set("X-Proxy-Version", version)
+	}
+	v.statusRecorder.WriteHeader(code)
+}
+
+func (v *versionWriter) Write(b []byte) (int, error) {
+	if v.status == 0 {
+		v.WriteHeader(http.StatusOK)
+	}
+	return v.statusRecorder.Write(b)
+}
+
+// decompressRequest replaces a gzip or brotli request body with its
+// decompressed content and drops the Content-Encoding header, so the
+// handlers always read plain JSON
+func decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.ReadCloser
+		switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip":
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				reqLog(r.Context(), "Error reading gzip request body: %v", err)
+				writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Invalid gzip request body")
+				return
+			}
+			body = reader
+		case "br":
+			body = io.NopCloser(brotli.NewReader(r.Body))
+		default:
+			reqLog(r.Context(), "Rejected request with Content-Encoding %q", encoding)
+			writeError(w, http.StatusUnsupportedMediaType, errTypeInvalidRequest, "Unsupported Content-Encoding")
+			return
+		}
+		defer body.Close()
+
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		next.ServeHTTP(w, r)
+	})
+}
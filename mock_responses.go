@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// MockFixture is the canned completion returned for a model in MOCK_MODE
+type MockFixture struct {
+	Content          string `json:"content"`
+	FinishReason     string `json:"finish_reason"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+}
+
+// MockFixtures holds the fixture of each model and the default one
+type MockFixtures struct {
+	Default MockFixture            `json:"default"`
+	Models  map[string]MockFixture `json:"models"`
+}
+
+// Fixtures used when MOCK_RESPONSES_FILE is not set
+//
+//go:embed testdata/mock_responses.json
+var bundledMockResponses []byte
+
+// mockChunks is the number of SSE data chunks of a mocked stream
+const mockChunks = 3
+
+// mockTransport answers upstream calls with fixtures instead of contacting
+// OpenRouter, so the proxy can run in CI without a key or network access
+type mockTransport struct {
+	fixtures    MockFixtures
+	streamDelay time.Duration
+}
+
+// newMockTransport loads the fixtures from MOCK_RESPONSES_FILE or the
+// bundled defaults
+func newMockTransport() *mockTransport {
+	data := bundledMockResponses
+	if path := os.Getenv("MOCK_RESPONSES_FILE"); path != "" {
+		fileData, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading MOCK_RESPONSES_FILE: %v", err)
+		}
+		data = fileData
+	}
+
+	t := &mockTransport{streamDelay: envDuration("MOCK_STREAM_DELAY", 100*time.Millisecond)}
+	if err := json.Unmarshal(data, &t.fixtures); err != nil {
+		log.Fatalf("Error parsing mock responses: %v", err)
+	}
+	return t
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/chat/completions"):
+		var chatReq OpenRouterRequest
+		if err := json.NewDecoder(req.Body).Decode(&chatReq); err != nil {
+			return mockResponse(req, http.StatusBadRequest, "application/json", errorBody(http.StatusBadRequest, errTypeInvalidRequest, "Invalid mock request body")), nil
+		}
+		fixture, ok := t.fixtures.Models[chatReq.Model]
+		if !ok {
+			fixture = t.fixtures.Default
+		}
+		if chatReq.Stream {
+			return t.streamResponse(req, chatReq.Model, fixture), nil
+		}
+		return mockResponse(req, http.StatusOK, "application/json", mockCompletion(chatReq.Model, fixture)), nil
+	case strings.HasSuffix(req.URL.Path, "/models"):
+		models := make([]map[string]string, 0, len(t.fixtures.Models))
+		for id := range t.fixtures.Models {
+			models = append(models, map[string]string{"id": id})
+		}
+		body, _ := json.Marshal(map[string]interface{}{"data": models})
+		return mockResponse(req, http.StatusOK, "application/json", body), nil
+	default:
+		return mockResponse(req, http.StatusNotFound, "application/json", errorBody(http.StatusNotFound, errTypeInvalidRequest, "Not mocked")), nil
+	}
+}
+
+// streamResponse splits the fixture content into mockChunks SSE chunks
+// written streamDelay apart, followed by the [DONE] sentinel
+func (t *mockTransport) streamResponse(req *http.Request, model string, fixture MockFixture) *http.Response {
+	reader, writer := io.Pipe()
+	go func() {
+		size := (len(fixture.Content) + mockChunks - 1) / mockChunks
+		for i := 0; i < mockChunks; i++ {
+			start, end := i*size, (i+1)*size
+			if start > len(fixture.Content) {
+				start = len(fixture.Content)
+			}
+			if end > len(fixture.Content) {
+				end = len(fixture.Content)
+			}
+			delta := map[string]interface{}{"content": fixture.Content[start:end]}
+			var finishReason interface{}
+			if i == mockChunks-1 {
+				finishReason = fixture.FinishReason
+			}
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"id":      "mock-" + requestIDFrom(req.Context()),
+				"object":  "chat.completion.chunk",
+				"created": time.Now().Unix(),
+				"model":   model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finishReason}},
+			})
+			if i > 0 {
+				select {
+				case <-time.After(t.streamDelay):
+				case <-req.Context().Done():
+					writer.CloseWithError(req.Context().Err())
+					return
+				}
+			}
+			if _, err := fmt.Fprintf(writer, "data: %s\n\n", chunk); err != nil {
+				return
+			}
+		}
+		fmt.Fprint(writer, doneSentinel)
+		writer.Close()
+	}()
+
+	resp := mockResponse(req, http.StatusOK, "text/event-stream", nil)
+	resp.Body = reader
+	resp.ContentLength = -1
+	return resp
+}
+
+// mockCompletion renders fixture as a chat completion of model
+func mockCompletion(model string, fixture MockFixture) []byte {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":      "mock-completion",
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"message":       map[string]string{"role": "assistant", "content": fixture.Content},
+			"finish_reason": fixture.FinishReason,
+		}},
+		"usage": map[string]int{
+			"prompt_tokens":     fixture.PromptTokens,
+			"completion_tokens": fixture.CompletionTokens,
+			"total_tokens":      fixture.PromptTokens + fixture.CompletionTokens,
+		},
+	})
+	return body
+}
+
+func mockResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{contentType}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
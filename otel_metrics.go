@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/aggregation"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// OpenTelemetry instruments, exported according to OTEL_METRICS_EXPORTER
+var (
+	otelMetricsEnabled bool
+
+	otelRequestDuration  metric.Float64Histogram
+	otelPromptTokens     metric.Int64Counter
+	otelCompletionTokens metric.Int64Counter
+	otelActiveStreams    metric.Int64UpDownCounter
+)
+
+// initOTelMetrics creates the OpenTelemetry instruments. OTEL_METRICS_EXPORTER
+// selects "otlp" (pushed to OTEL_EXPORTER_OTLP_ENDPOINT) or "prometheus"
+// (served on /metrics next to the native metrics); otherwise the instruments
+// come from a no-op provider and nothing is recorded.
+func initOTelMetrics() {
+	var provider metric.MeterProvider = noop.NewMeterProvider()
+	switch exporter := os.Getenv("OTEL_METRICS_EXPORTER"); exporter {
+	case "", "none":
+	case "otlp":
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "http://localhost:4318"
+		}
+		url := strings.TrimSuffix(endpoint, "/") + "/v1/metrics"
+		provider = sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(&otlpMetricExporter{url: url})),
+			sdkmetric.WithResource(otelResource()),
+		)
+		otelMetricsEnabled = true
+		log.Printf("Exporting OpenTelemetry metrics to %s", url)
+	case "prometheus":
+		reader := sdkmetric.NewManualReader()
+		provider = sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(reader),
+			sdkmetric.WithResource(otelResource()),
+		)
+		metricsRegistry.MustRegister(&otelCollector{reader: reader})
+		otelMetricsEnabled = true
+	default:
+		log.Printf("Warning: unsupported OTEL_METRICS_EXPORTER %q, OpenTelemetry metrics disabled", exporter)
+	}
+
+	// Instrument creation only fails on invalid names
+	meter := provider.Meter("cursor-openrouter-proxy")
+	otelRequestDuration, _ = meter.Float64Histogram("proxy.request.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("Duration of proxied requests, streaming included."))
+	otelPromptTokens, _ = meter.Int64Counter("proxy.upstream.tokens.prompt",
+		metric.WithDescription("Prompt tokens reported by the upstream."))
+	otelCompletionTokens, _ = meter.Int64Counter("proxy.upstream.tokens.completion",
+		metric.WithDescription("Completion tokens reported by the upstream."))
+	otelActiveStreams, _ = meter.Int64UpDownCounter("proxy.stream.active",
+		metric.WithDescription("Streamed responses in progress."))
+}
+
+// recordOTelRequest records a completed request on the OpenTelemetry
+// instruments
+func recordOTelRequest(ctx context.Context, summary *requestSummary, status int, durationMs float64) {
+	if !otelMetricsEnabled {
+		return
+	}
+	model := attribute.String("model", summary.model)
+	otelRequestDuration.Record(ctx, durationMs, metric.WithAttributes(model, attribute.Int("http.status_code", status)))
+	if summary.promptTokens > 0 || summary.completionTokens > 0 {
+		otelPromptTokens.Add(ctx, int64(summary.promptTokens), metric.WithAttributes(model))
+		otelCompletionTokens.Add(ctx, int64(summary.completionTokens), metric.WithAttributes(model))
+	}
+}
+
+// addOTelActiveStreams moves the proxy.stream.active counter by delta
+func addOTelActiveStreams(ctx context.Context, delta int64) {
+	if otelMetricsEnabled {
+		otelActiveStreams.Add(ctx, delta)
+	}
+}
+
+// otlpMetricExporter pushes metrics with the OTLP/HTTP JSON encoding
+type otlpMetricExporter struct {
+	url string
+}
+
+func (e *otlpMetricExporter) Temporality(kind sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(kind)
+}
+
+func (e *otlpMetricExporter) Aggregation(kind sdkmetric.InstrumentKind) aggregation.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(kind)
+}
+
+// otlpTemporality maps SDK temporalities to the OTLP enum
+func otlpTemporality(t metricdata.Temporality) int {
+	switch t {
+	case metricdata.DeltaTemporality:
+		return 1
+	case metricdata.CumulativeTemporality:
+		return 2
+	}
+	return 0
+}
+
+func (e *otlpMetricExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	scopes := make([]interface{}, 0, len(rm.ScopeMetrics))
+	for _, sm := range rm.ScopeMetrics {
+		metrics := make([]interface{}, 0, len(sm.Metrics))
+		for _, m := range sm.Metrics {
+			encoded := map[string]interface{}{
+				"name":        m.Name,
+				"description": m.Description,
+				"unit":        m.Unit,
+			}
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				points := make([]interface{}, 0, len(data.DataPoints))
+				for _, dp := range data.DataPoints {
+					points = append(points, map[string]interface{}{
+						"attributes":        otlpAttributes(dp.Attributes.ToSlice()),
+						"startTimeUnixNano": otlpTime(dp.StartTime),
+						"timeUnixNano":      otlpTime(dp.Time),
+						"asInt":             strconv.FormatInt(dp.Value, 10),
+					})
+				}
+				encoded["sum"] = map[string]interface{}{
+					"dataPoints":             points,
+					"aggregationTemporality": otlpTemporality(data.Temporality),
+					"isMonotonic":            data.IsMonotonic,
+				}
+			case metricdata.Histogram[float64]:
+				points := make([]interface{}, 0, len(data.DataPoints))
+				for _, dp := range data.DataPoints {
+					counts := make([]string, len(dp.BucketCounts))
+					for i, c := range dp.BucketCounts {
+						counts[i] = strconv.FormatUint(c, 10)
+					}
+					points = append(points, map[string]interface{}{
+						"attributes":        otlpAttributes(dp.Attributes.ToSlice()),
+						"startTimeUnixNano": otlpTime(dp.StartTime),
+						"timeUnixNano":      otlpTime(dp.Time),
+						"count":             strconv.FormatUint(dp.Count, 10),
+						"sum":               dp.Sum,
+						"bucketCounts":      counts,
+						"explicitBounds":    dp.Bounds,
+					})
+				}
+				encoded["histogram"] = map[string]interface{}{
+					"dataPoints":             points,
+					"aggregationTemporality": otlpTemporality(data.Temporality),
+				}
+			default:
+				// The proxy creates no other kind of instrument
+				continue
+			}
+			metrics = append(metrics, encoded)
+		}
+		scopes = append(scopes, map[string]interface{}{
+			"scope":   map[string]interface{}{"name": sm.Scope.Name},
+			"metrics": metrics,
+		})
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource":     map[string]interface{}{"attributes": otlpAttributes(rm.Resource.Attributes())},
+			"scopeMetrics": scopes,
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("encoding metrics: %w", err)
+	}
+	if err := postOTLP(ctx, e.url, payload); err != nil {
+		return fmt.Errorf("exporting metrics: %w", err)
+	}
+	return nil
+}
+
+func (e *otlpMetricExporter) ForceFlush(ctx context.Context) error {
+	return nil
+}
+
+func (e *otlpMetricExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// otelCollector exposes the OpenTelemetry instruments in the Prometheus
+// registry. It is unchecked (Describe sends nothing) because the label sets
+// are only known once collected.
+type otelCollector struct {
+	reader sdkmetric.Reader
+}
+
+func (c *otelCollector) Describe(chan<- *prometheus.Desc) {}
+
+// prometheusName turns an OpenTelemetry instrument name into a Prometheus
+// metric name, e.g. proxy.request.duration in ms becomes
+// proxy_request_duration_milliseconds
+func prometheusName(name, unit string) string {
+	name = strings.ReplaceAll(name, ".", "_")
+	if unit == "ms" {
+		name += "_milliseconds"
+	}
+	return name
+}
+
+// prometheusLabels splits an attribute set into label names and values
+func prometheusLabels(attrs attribute.Set) ([]string, []string) {
+	var names, values []string
+	for _, kv := range attrs.ToSlice() {
+		names = append(names, strings.ReplaceAll(string(kv.Key), ".", "_"))
+		values = append(values, kv.Value.Emit())
+	}
+	return names, values
+}
+
+// collectOTelMetric returns a function sending a converted metric to ch, or
+// logging why it could not be converted: a bad label set must not panic the
+// /metrics handler
+func collectOTelMetric(ch chan<- prometheus.Metric, name string) func(prometheus.Metric, error) {
+	return func(m prometheus.Metric, err error) {
+		if err != nil {
+			log.Printf("Warning: skipping OpenTelemetry metric %s: %v", name, err)
+			return
+		}
+		ch <- m
+	}
+}
+
+func (c *otelCollector) Collect(ch chan<- prometheus.Metric) {
+	var rm metricdata.ResourceMetrics
+	if err := c.reader.Collect(context.Background(), &rm); err != nil {
+		log.Printf("Warning: collecting OpenTelemetry metrics: %v", err)
+		return
+	}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			name := prometheusName(m.Name, m.Unit)
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				valueType := prometheus.GaugeValue
+				if data.IsMonotonic {
+					name += "_total"
+					valueType = prometheus.CounterValue
+				}
+				for _, dp := range data.DataPoints {
+					names, values := prometheusLabels(dp.Attributes)
+					desc := prometheus.NewDesc(name, m.Description, names, nil)
+					collectOTelMetric(ch, name)(prometheus.NewConstMetric(desc, valueType, float64(dp.Value), values...))
+				}
+			case metricdata.Histogram[float64]:
+				for _, dp := range data.DataPoints {
+					// Prometheus buckets are cumulative, OpenTelemetry ones are not
+					buckets := make(map[float64]uint64, len(dp.Bounds))
+					var cumulative uint64
+					for i, bound := range dp.Bounds {
+						cumulative += dp.BucketCounts[i]
+						buckets[bound] = cumulative
+					}
+					names, values := prometheusLabels(dp.Attributes)
+					desc := prometheus.NewDesc(name, m.Description, names, nil)
+					collectOTelMetric(ch, name)(prometheus.NewConstHistogram(desc, dp.Count, dp.Sum, buckets, values...))
+				}
+			}
+		}
+	}
+}
+
+var otlpClient = &http.Client{Timeout: 10 * time.Second}
+
+// otlpValue encodes an attribute value as an OTLP AnyValue
+func otlpValue(v attribute.Value) map[string]interface{} {
+	switch v.Type() {
+	case attribute.BOOL:
+		return map[string]interface{}{"boolValue": v.AsBool()}
+	case attribute.INT64:
+		// 64-bit integers are strings in the OTLP JSON mapping
+		return map[string]interface{}{"intValue": strconv.FormatInt(v.AsInt64(), 10)}
+	case attribute.FLOAT64:
+		return map[string]interface{}{"doubleValue": v.AsFloat64()}
+	default:
+		return map[string]interface{}{"stringValue": v.Emit()}
+	}
+}
+
+func otlpAttributes(attrs []attribute.KeyValue) []map[string]interface{} {
+	out := make([]map[string]interface{}, 0, len(attrs))
+	for _, kv := range attrs {
+		out = append(out, map[string]interface{}{"key": string(kv.Key), "value": otlpValue(kv.Value)})
+	}
+	return out
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// postOTLP sends an OTLP/HTTP JSON payload to url
+func postOTLP(ctx context.Context, url string, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTelMetrics(t *testing.T) {
+	summary := &requestSummary{model: "openai/gpt-4o", promptTokens: 12, completionTokens: 34}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Setenv("OTEL_METRICS_EXPORTER", "")
+		initOTelMetrics()
+		if otelMetricsEnabled {
+			t.Fatal("metrics enabled without OTEL_METRICS_EXPORTER")
+		}
+		recordOTelRequest(context.Background(), summary, http.StatusOK, 42)
+		addOTelActiveStreams(context.Background(), 1)
+	})
+
+	t.Run("prometheus", func(t *testing.T) {
+		t.Setenv("OTEL_METRICS_EXPORTER", "prometheus")
+		registry := metricsRegistry
+		metricsRegistry = prometheus.NewRegistry()
+		initOTelMetrics()
+		t.Cleanup(func() { metricsRegistry, otelMetricsEnabled = registry, false })
+		recordOTelRequest(context.Background(), summary, http.StatusOK, 42)
+		addOTelActiveStreams(context.Background(), 1)
+
+		rec := httptest.NewRecorder()
+		handleMetricsRoute(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		for _, name := range []string{
+			"proxy_request_duration_milliseconds_count",
+			"proxy_upstream_tokens_prompt_total",
+			"proxy_upstream_tokens_completion_total",
+			"proxy_stream_active",
+		} {
+			if !strings.Contains(rec.Body.String(), name) {
+				t.Errorf("/metrics is missing %s", name)
+			}
+		}
+	})
+}
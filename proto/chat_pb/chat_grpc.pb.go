@@ -0,0 +1,185 @@
+// gRPC front end of the proxy, enabled with GRPC_ADDR. Requests go through
+// the same model rewriting and forwarding as /v1/chat/completions.
+//
+// Regenerate from the repository root with:
+//   protoc --go_out=. --go_opt=module=cursor-proxy \
+//     --go-grpc_out=. --go-grpc_opt=module=cursor-proxy proto/chat.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: proto/chat.proto
+
+package chat_pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ChatService_Complete_FullMethodName       = "/cursorproxy.chat.v1.ChatService/Complete"
+	ChatService_StreamComplete_FullMethodName = "/cursorproxy.chat.v1.ChatService/StreamComplete"
+)
+
+// ChatServiceClient is the client API for ChatService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChatServiceClient interface {
+	// Complete returns the whole completion at once
+	Complete(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*ChatResponse, error)
+	// StreamComplete sends one response per streamed chunk
+	StreamComplete(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (ChatService_StreamCompleteClient, error)
+}
+
+type chatServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChatServiceClient(cc grpc.ClientConnInterface) ChatServiceClient {
+	return &chatServiceClient{cc}
+}
+
+func (c *chatServiceClient) Complete(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (*ChatResponse, error) {
+	out := new(ChatResponse)
+	err := c.cc.Invoke(ctx, ChatService_Complete_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chatServiceClient) StreamComplete(ctx context.Context, in *ChatRequest, opts ...grpc.CallOption) (ChatService_StreamCompleteClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ChatService_ServiceDesc.Streams[0], ChatService_StreamComplete_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chatServiceStreamCompleteClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ChatService_StreamCompleteClient interface {
+	Recv() (*ChatResponse, error)
+	grpc.ClientStream
+}
+
+type chatServiceStreamCompleteClient struct {
+	grpc.ClientStream
+}
+
+func (x *chatServiceStreamCompleteClient) Recv() (*ChatResponse, error) {
+	m := new(ChatResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ChatServiceServer is the server API for ChatService service.
+// All implementations must embed UnimplementedChatServiceServer
+// for forward compatibility
+type ChatServiceServer interface {
+	// Complete returns the whole completion at once
+	Complete(context.Context, *ChatRequest) (*ChatResponse, error)
+	// StreamComplete sends one response per streamed chunk
+	StreamComplete(*ChatRequest, ChatService_StreamCompleteServer) error
+	mustEmbedUnimplementedChatServiceServer()
+}
+
+// UnimplementedChatServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedChatServiceServer struct {
+}
+
+func (UnimplementedChatServiceServer) Complete(context.Context, *ChatRequest) (*ChatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Complete not implemented")
+}
+func (UnimplementedChatServiceServer) StreamComplete(*ChatRequest, ChatService_StreamCompleteServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamComplete not implemented")
+}
+func (UnimplementedChatServiceServer) mustEmbedUnimplementedChatServiceServer() {}
+
+// UnsafeChatServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChatServiceServer will
+// result in compilation errors.
+type UnsafeChatServiceServer interface {
+	mustEmbedUnimplementedChatServiceServer()
+}
+
+func RegisterChatServiceServer(s grpc.ServiceRegistrar, srv ChatServiceServer) {
+	s.RegisterService(&ChatService_ServiceDesc, srv)
+}
+
+func _ChatService_Complete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChatServiceServer).Complete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChatService_Complete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChatServiceServer).Complete(ctx, req.(*ChatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChatService_StreamComplete_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ChatRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ChatServiceServer).StreamComplete(m, &chatServiceStreamCompleteServer{stream})
+}
+
+type ChatService_StreamCompleteServer interface {
+	Send(*ChatResponse) error
+	grpc.ServerStream
+}
+
+type chatServiceStreamCompleteServer struct {
+	grpc.ServerStream
+}
+
+func (x *chatServiceStreamCompleteServer) Send(m *ChatResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// ChatService_ServiceDesc is the grpc.ServiceDesc for ChatService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChatService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "cursorproxy.chat.v1.ChatService",
+	HandlerType: (*ChatServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Complete",
+			Handler:    _ChatService_Complete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamComplete",
+			Handler:       _ChatService_StreamComplete_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/chat.proto",
+}
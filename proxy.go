@@ -3,76 +3,499 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/zlib"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	_ "embed"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
+	"cursor-proxy/proto/chat_pb"
+
 	"github.com/andybalholm/brotli"
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/http2"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	openRouterEndpoint = "https://openrouter.ai/api/v1"
 	openRouterModel    = "openai/gpt-4o"
-	cursorMockedModel  = "gpt-4o"
 )
 
 var (
 	openRouterAPIKey string
+
+	// Model name Cursor sends, also written back as the model in responses
+	cursorMockedModel = "gpt-4o"
+
+	// Incoming model names rewritten to the configured OpenRouter model
+	cursorMockedModels []string
+
+	// Providers that reject the parallel_tool_calls field
+	ignoreParallelToolCallsProviders []string
+
+	// Providers given a tool_choice naming a specific function; the others
+	// get "auto"
+	toolChoicePassthroughProviders = []string{"openai", "anthropic"}
+
+	// Bearer token required on the /v1/config endpoints, when set
+	configAuthToken string
+
+	// Short model names (e.g. "fast") mapped to OpenRouter model IDs
+	modelAliases map[string]string
+
+	// Per-key request budgets in requests per minute, and the limit in
+	// requests per second shared by all other keys (0 disables it)
+	keyRateLimits   map[string]int
+	globalRateLimit float64
+
+	// Lazily created *rate.Limiter per KEY_RATE_LIMITS key, and the limiter
+	// shared by all other keys, so a client cannot escape RATE_LIMIT_RPS by
+	// sending a new key with each request
+	rateLimiters  sync.Map
+	sharedLimiter *rate.Limiter
+
+	// Check POST /v1/config models against the OpenRouter catalog
+	validateModelOnConfig bool
+	modelListCacheTTL     time.Duration
+)
+
+// ModelConstraints limits the parameters forwarded for a provider. Zero
+// values mean no limit. DefaultMaxTokens is sent when the client sets none.
+type ModelConstraints struct {
+	MaxTemperature   float64 `json:"max_temperature"`
+	MaxTopP          float64 `json:"max_top_p"`
+	MaxOutputTokens  int     `json:"max_output_tokens"`
+	DefaultMaxTokens int     `json:"default_max_tokens"`
+	OmitMaxTokens    bool    `json:"omit_max_tokens"`
+}
+
+// Bundled provider constraints, keyed by provider prefix (e.g. "google/")
+//
+//go:embed provider_constraints.json
+var bundledProviderConstraints []byte
+
+var providerConstraints map[string]ModelConstraints
+
+// ModelCapabilities describes the features supported by a model
+type ModelCapabilities struct {
+	Tools      bool `json:"tools"`
+	Vision     bool `json:"vision"`
+	Streaming  bool `json:"streaming"`
+	JSONMode   bool `json:"json_mode"`
+	MaxContext int  `json:"max_context"`
+	MaxOutput  int  `json:"max_output"`
+	Stale      bool `json:"stale,omitempty"`
+}
+
+// discoveredCapability is a capability cache entry learned from the
+// OpenRouter model list
+type discoveredCapability struct {
+	capabilities ModelCapabilities
+	fetchedAt    time.Time
+}
+
+var (
+	discoveredMu           sync.RWMutex
+	discoveredCapabilities = make(map[string]discoveredCapability)
 )
 
+// updateDiscoveredCapabilities parses an OpenRouter /models response into
+// the capability cache
+func updateDiscoveredCapabilities(body []byte) error {
+	var list struct {
+		Data []struct {
+			ID            string `json:"id"`
+			ContextLength int    `json:"context_length"`
+			Architecture  struct {
+				Modality        string   `json:"modality"`
+				InputModalities []string `json:"input_modalities"`
+			} `json:"architecture"`
+			TopProvider struct {
+				MaxCompletionTokens int `json:"max_completion_tokens"`
+			} `json:"top_provider"`
+			SupportedParameters []string `json:"supported_parameters"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	discoveredMu.Lock()
+	defer discoveredMu.Unlock()
+	for _, model := range list.Data {
+		vision := strings.Contains(strings.Split(model.Architecture.Modality, "->")[0], "image")
+		for _, modality := range model.Architecture.InputModalities {
+			vision = vision || modality == "image"
+		}
+		capabilities := ModelCapabilities{
+			Vision:     vision,
+			Streaming:  true,
+			MaxContext: model.ContextLength,
+			MaxOutput:  model.TopProvider.MaxCompletionTokens,
+		}
+		for _, param := range model.SupportedParameters {
+			switch param {
+			case "tools":
+				capabilities.Tools = true
+			case "response_format":
+				capabilities.JSONMode = true
+			}
+		}
+		discoveredCapabilities[model.ID] = discoveredCapability{capabilities: capabilities, fetchedAt: now}
+	}
+	return nil
+}
+
+// capabilitiesFor returns the capabilities of model, preferring the
+// discovered ones. Discovered entries missed by the last two refreshes are
+// marked stale.
+func capabilitiesFor(model string) (ModelCapabilities, bool) {
+	discoveredMu.RLock()
+	discovered, ok := discoveredCapabilities[model]
+	discoveredMu.RUnlock()
+	if ok {
+		capabilities := discovered.capabilities
+		capabilities.Stale = time.Since(discovered.fetchedAt) > 2*capabilityRefreshInterval
+		return capabilities, true
+	}
+	capabilities, ok := modelCapabilities[model]
+	return capabilities, ok
+}
+
+var capabilityRefreshInterval time.Duration
+
+// refreshCapabilitiesPeriodically refreshes the model list, and with it the
+// capability cache, every CAPABILITY_REFRESH_INTERVAL seconds
+func refreshCapabilitiesPeriodically() {
+	go func() {
+		for range time.Tick(capabilityRefreshInterval) {
+			if _, _, err := refreshModels(); err != nil {
+				log.Printf("Warning: refreshing model capabilities failed: %v", err)
+			}
+		}
+	}()
+}
+
+// OpenAPI description of the proxy endpoints, served as JSON on
+// GET /openapi.json
+//
+//go:embed api/openapi.yaml
+var openAPISpec []byte
+
+// Bundled capability matrix, keyed by model ID
+//
+//go:embed capabilities.json
+var bundledCapabilities []byte
+
+var modelCapabilities map[string]ModelCapabilities
+
+// Cached set of model IDs from the OpenRouter catalog
+var modelCatalog struct {
+	sync.Mutex
+	ids    map[string]bool
+	expiry time.Time
+}
+
+// version of the proxy, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 // Configuration structure
 type Config struct {
-	endpoint string
-	model    string
-	apiKey   string
+	endpoint  string
+	model     string
+	apiKey    string
+	userAgent string
+
+	// HTTP-Referer and X-Title sent to OpenRouter, which attributes usage
+	// to the app they name
+	referer string
+	title   string
 }
 
-var activeConfig Config
+// configState is the configuration requests are served with. It is
+// replaced as a whole and never modified in place, so a request reading it
+// once sees a consistent config while the config API, a key refresh or a
+// named config activation publish another.
+type configState struct {
+	config Config
+
+	// name is the named config in use, "default" for the one from the
+	// environment and "custom" once the config was changed field by field
+	name string
+
+	// selector is nil unless OPENROUTER_MODELS is set; a model switch
+	// through /v1/config clears it
+	selector *weightedSelector
+
+	// Models tried in order when the provider of the selected model is down
+	fallbackModels []string
+}
+
+var (
+	activeState   atomic.Pointer[configState]
+	activeStateMu sync.Mutex
+)
+
+// updateActiveState publishes a copy of the active state changed by update.
+// Updates are serialized so concurrent ones are not lost.
+func updateActiveState(update func(state *configState)) *configState {
+	activeStateMu.Lock()
+	defer activeStateMu.Unlock()
+	state := *activeState.Load()
+	update(&state)
+	activeState.Store(&state)
+	return &state
+}
+
+// Global HTTP client with optimized settings, built by newHTTPClient
+var httpClient *http.Client
+
+// newHTTPClient returns the client used for upstream calls: a standard
+// transport negotiating HTTP/2, so proxy settings and the HTTP1_* pool
+// settings apply whichever protocol OpenRouter ends up speaking
+func newHTTPClient() *http.Client {
+	// NO_PROXY is honored by http.ProxyFromEnvironment
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        envInt("HTTP1_MAX_IDLE_CONNS", 100),
+		MaxIdleConnsPerHost: envInt("HTTP1_MAX_IDLE_CONNS_PER_HOST", 10),
+		IdleConnTimeout:     envDuration("HTTP1_IDLE_CONN_TIMEOUT", 90*time.Second),
+		DisableKeepAlives:   os.Getenv("HTTP1_DISABLE_KEEP_ALIVES") == "true",
+	}
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		log.Fatalf("Error configuring HTTP/2 transport: %v", err)
+	}
+	h2.ReadIdleTimeout = 30 * time.Second
+	h2.PingTimeout = 10 * time.Second
+	h2.WriteByteTimeout = 15 * time.Second
+
+	// The x/net client takes its stream limit and flow control window from
+	// the server; it can only be told to queue requests over the stream
+	// limit and to accept smaller frames
+	h2.StrictMaxConcurrentStreams = os.Getenv("HTTP2_STRICT_MAX_CONCURRENT_STREAMS") == "true"
+	h2.MaxReadFrameSize = uint32(envInt("HTTP2_MAX_READ_FRAME_SIZE", 0))
+	for _, name := range []string{"HTTP2_MAX_CONCURRENT_STREAMS", "HTTP2_CONN_FLOW_CONTROL"} {
+		if os.Getenv(name) != "" {
+			log.Printf("Warning: %s is not supported by the HTTP/2 client transport and is ignored", name)
+		}
+	}
 
-// Global HTTP client with optimized settings
-var httpClient = &http.Client{
-	Transport: &http2.Transport{
-		AllowHTTP: true,
-		DialTLS:   nil,
-		// Optimize connection pooling
-		ReadIdleTimeout:  30 * time.Second,
-		PingTimeout:      10 * time.Second,
-		WriteByteTimeout: 15 * time.Second,
-	},
-	Timeout: 5 * time.Minute,
+	log.Printf("Using HTTP/2 transport with HTTP/1.1 fallback (max idle: %d, per host: %d, idle timeout: %s, keep-alives: %t, strict max streams: %t, max read frame: %d)",
+		transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout, !transport.DisableKeepAlives,
+		h2.StrictMaxConcurrentStreams, h2.MaxReadFrameSize)
+	return &http.Client{
+		Transport: transport,
+		Timeout:   5 * time.Minute,
+	}
 }
 
 var (
-	// Buffer pools for various sizes
+	// Buffer pools for various sizes, split at bufferSmallThreshold
 	smallBufferPool = sync.Pool{
 		New: func() interface{} {
-			return new(bytes.Buffer)
+			return bytes.NewBuffer(make([]byte, 0, bufferSmallThreshold))
 		},
 	}
 
 	largeBufferPool = sync.Pool{
 		New: func() interface{} {
-			return new(bytes.Buffer)
+			return bytes.NewBuffer(make([]byte, 0, bufferLargeInitialSize))
 		},
 	}
 
+	// Size above which STREAM_LARGE_RESPONSES pipes responses (bytes)
+	largeResponseThreshold int64 = 1 << 20
+
+	// Buffer pool tuning (BUFFER_SMALL_THRESHOLD, BUFFER_LARGE_INITIAL_SIZE)
+	bufferSmallThreshold   = 1024
+	bufferLargeInitialSize = 65536
+
 	// Debug mode flag
-	debugMode = os.Getenv("DEBUG") == "true"
+	debugMode bool
+
+	// Log message contents outside of debug mode
+	logPII bool
+
+	// Drop SSE lines that are not comments or data/event/id fields
+	strictSSE bool
+
+	// Drop SSE data lines whose payload is not valid JSON, and abort the
+	// stream after invalidChunkThreshold of them
+	validateSSEJSON       bool
+	invalidChunkThreshold = 5
+
+	// Count streamed tokens locally and append a usage chunk when upstream
+	// sends none, for every model or for the providers of
+	// COUNT_STREAM_TOKENS_MODEL
+	countStreamTokens          bool
+	countStreamTokensProviders []string
+
+	// Let clients pick the model of a request with the X-Proxy-Model header
+	allowModelOverride bool
+
+	// Let clients set the upstream retries of a request with the
+	// X-Proxy-Max-Retries header
+	allowRetryOverride bool
+
+	// Do not ask upstream for compressed responses
+	disableUpstreamCompression bool
+
+	// Pipe large non-streaming responses to the client without buffering them
+	streamLargeResponses bool
+
+	// Share responses between identical concurrent non-streaming requests.
+	// A request waits at most deduplicationWait for the identical one before
+	// going upstream itself (DEDUPLICATION_WAIT_TIMEOUT).
+	deduplicationEnabled bool
+	deduplicationWait    = 60 * time.Second
+
+	// Forward fine-tuned (ft:) model IDs without rewriting them
+	allowFineTunedModels bool
+
+	// Add the local capabilities to the /v1/models list
+	enrichModels bool
+
+	// Only accept the mocked model names (OPENAI_STRICT_MODE); otherwise any
+	// model is passed through to OpenRouter
+	openAIStrictMode bool
+
+	// Accept Anthropic-format (sk-ant-) keys from clients
+	allowAnthropicKeys bool
+
+	// Hash client addresses written to the audit log
+	auditHashIP bool
+
+	// Answer upstream calls with canned responses (MOCK_MODE), set by
+	// loadConfig
+	mockMode bool
+
+	// Share the listening port with other proxy processes (SO_REUSEPORT)
+	reusePort bool
+
+	// Serve the expvar variables on GET /debug/vars
+	enableDebugEndpoint bool
+
+	// Reflect requests on /v1/echo, to diagnose transport issues
+	enableEcho bool
+
+	// Serve POST /v1/benchmark, which sends real (billed) upstream requests
+	enableBenchmark bool
+
+	// Timeout of each benchmark sample (BENCHMARK_TIMEOUT)
+	benchmarkTimeout = 30 * time.Second
+
+	// Requests of a batch processed at once (BATCH_CONCURRENCY) and the
+	// timeout of the whole batch (BATCH_TIMEOUT)
+	batchConcurrency = 5
+	batchTimeout     = 60 * time.Second
+
+	// Time a stream may go without an upstream line before it is ended
+	// (STREAM_CHUNK_TIMEOUT, 0 to wait forever)
+	streamChunkTimeout = 60 * time.Second
+
+	// Interval of the heartbeat comments sent on idle streams
+	streamHeartbeatInterval = 15 * time.Second
+
+	// Streamed tokens between two progress comments
+	// (PROGRESS_INTERVAL_TOKENS, 0 disables them)
+	progressIntervalTokens int
+
+	// Requests taking longer are logged as slow (SLOW_REQUEST_THRESHOLD_MS,
+	// 0 disables it)
+	slowRequestThreshold time.Duration
+
+	// Messages forwarded per request before the oldest non-system ones are
+	// dropped (MAX_MESSAGES, 0 for no limit), and whether the first kept
+	// message notes the removal (TRUNCATE_STRATEGY=summarize)
+	maxMessages      int
+	truncateStrategy string
+
+	// How long the response of a request with an Idempotency-Key is replayed
+	// to retries (IDEMPOTENCY_TTL)
+	idempotencyTTL = 60 * time.Second
+
+	// Top-level fields removed from non-streaming responses
+	stripResponseFields []string
+
+	// Remove reasoning fields from responses, for clients that reject them
+	stripReasoning bool
+
+	// Report the requested model instead of the upstream one in responses
+	// (RESPONSE_MODEL_REWRITE), and in stream chunks too
+	// (REWRITE_STREAM_MODEL)
+	rewriteResponseModel bool
+	rewriteStreamModel   bool
+
+	// finish_reason of the chunk sent before [DONE] when no chunk of the
+	// stream had one (DEFAULT_FINISH_REASON, none to send no such chunk)
+	defaultFinishReason = "stop"
+
+	// Pass rate limit and request ID headers of OpenRouter to clients
+	forwardUpstreamHeadersEnabled bool
+
+	// Upstream variants of the final SSE line, all sent to clients as doneSentinel
+	doneSentinels = []string{"data: [DONE]"}
 )
 
+const doneSentinel = "data: [DONE]\n\n"
+
 func getBuffer(size int) *bytes.Buffer {
 	var buf *bytes.Buffer
-	if size < 1024 {
+	if size < bufferSmallThreshold {
 		buf = smallBufferPool.Get().(*bytes.Buffer)
 	} else {
 		buf = largeBufferPool.Get().(*bytes.Buffer)
@@ -82,7 +505,7 @@ func getBuffer(size int) *bytes.Buffer {
 }
 
 func putBuffer(buf *bytes.Buffer) {
-	if buf.Cap() < 1024 {
+	if buf.Cap() < bufferSmallThreshold {
 		smallBufferPool.Put(buf)
 	} else {
 		largeBufferPool.Put(buf)
@@ -90,30 +513,152 @@ func putBuffer(buf *bytes.Buffer) {
 }
 
 func init() {
-	// Check environment variables first
-	openRouterAPIKey = os.Getenv("OPENROUTER_API_KEY")
+	// -validate reports configuration errors instead of exiting on the first
+	if !validateRequested() {
+		loadConfig()
+	}
+	initMetrics()
+	publishExpvars()
+}
+
+// loadConfig reads the proxy configuration from the environment (and .env)
+// and initializes the active config
+func loadConfig() {
+	// Environment variables take precedence over .env files
+	loadDotEnv()
+
+	// Feature flags are read here, after the .env files are loaded, rather
+	// than when the package variables are initialized
+	debugMode = os.Getenv("DEBUG") == "true"
+	logPII = os.Getenv("LOG_PII") == "true"
+	strictSSE = os.Getenv("STRICT_SSE") == "true"
+	validateSSEJSON = os.Getenv("VALIDATE_SSE_JSON") == "true"
+	countStreamTokens = os.Getenv("COUNT_STREAM_TOKENS") == "true"
+	allowModelOverride = os.Getenv("ALLOW_MODEL_OVERRIDE") == "true"
+	allowRetryOverride = os.Getenv("ALLOW_RETRY_OVERRIDE") == "true"
+	disableUpstreamCompression = os.Getenv("DISABLE_UPSTREAM_COMPRESSION") == "true"
+	streamLargeResponses = os.Getenv("STREAM_LARGE_RESPONSES") == "true"
+	deduplicationEnabled = os.Getenv("ENABLE_DEDUPLICATION") == "true"
+	allowFineTunedModels = os.Getenv("ALLOW_FINE_TUNED_MODELS") == "true"
+	enrichModels = os.Getenv("ENRICH_MODELS") == "true"
+	openAIStrictMode = os.Getenv("OPENAI_STRICT_MODE") != "false"
+	allowAnthropicKeys = os.Getenv("ALLOW_ANTHROPIC_KEYS") == "true"
+	auditHashIP = os.Getenv("AUDIT_HASH_IP") == "true"
+	reusePort = os.Getenv("REUSEPORT") == "true"
+	enableDebugEndpoint = os.Getenv("ENABLE_DEBUG_ENDPOINT") == "true"
+	enableEcho = os.Getenv("ENABLE_ECHO") == "true"
+	enableBenchmark = os.Getenv("ENABLE_BENCHMARK") == "true"
+	stripReasoning = os.Getenv("STRIP_REASONING") == "true"
+	rewriteResponseModel = os.Getenv("RESPONSE_MODEL_REWRITE") != "false"
+	rewriteStreamModel = os.Getenv("REWRITE_STREAM_MODEL") != "false"
+	forwardUpstreamHeadersEnabled = os.Getenv("FORWARD_UPSTREAM_HEADERS") != "false"
+
+	// The key may refer to a secret store (ssm:/path or vault:path#field)
+	apiKey, err := resolveSecret(os.Getenv("OPENROUTER_API_KEY"))
+	if err != nil {
+		log.Fatalf("Error loading OPENROUTER_API_KEY: %v", err)
+	}
+	openRouterAPIKey = apiKey
 	defaultModel := os.Getenv("OPENROUTER_MODEL")
 
-	// If key or model is missing, try loading from .env file
-	if openRouterAPIKey == "" || defaultModel == "" {
-		if err := godotenv.Load(); err != nil {
-			log.Printf("Warning: .env file not found or error loading it: %v", err)
+	// Ensure API key is provided and has correct format; MOCK_MODE never
+	// calls OpenRouter so it runs without one
+	mockMode = os.Getenv("MOCK_MODE") == "true"
+	if !mockMode {
+		if !strings.HasPrefix(openRouterAPIKey, "sk-or-") {
+			log.Fatal("OPENROUTER_API_KEY must start with 'sk-or-'")
+		}
+		if len(openRouterAPIKey) < 32 {
+			log.Fatal("OPENROUTER_API_KEY seems too short to be valid")
+		}
+	}
+
+	configAuthToken = os.Getenv("CONFIG_AUTH_TOKEN")
+	if configAuthToken == "" {
+		log.Printf("Warning: CONFIG_AUTH_TOKEN is not set, /v1/config endpoints are unauthenticated")
+	}
+
+	validateModelOnConfig = os.Getenv("VALIDATE_MODEL_ON_CONFIG") == "true"
+	modelListCacheTTL = time.Duration(envInt("MODEL_LIST_CACHE_TTL", 300)) * time.Second
+
+	// Load provider constraints, preferring an operator supplied file
+	constraintsData := bundledProviderConstraints
+	if path := os.Getenv("PROVIDER_CONSTRAINTS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading PROVIDER_CONSTRAINTS_FILE: %v", err)
+		}
+		constraintsData = data
+	}
+	if err := json.Unmarshal(constraintsData, &providerConstraints); err != nil {
+		log.Fatalf("Error parsing provider constraints: %v", err)
+	}
+	for prefix, c := range providerConstraints {
+		if normalized := normalizeModelID(prefix); normalized != prefix {
+			delete(providerConstraints, prefix)
+			providerConstraints[normalized] = c
+		}
+	}
+
+	// Load the capability matrix, preferring an operator supplied file
+	capabilitiesData := bundledCapabilities
+	if path := os.Getenv("CAPABILITIES_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Error reading CAPABILITIES_FILE: %v", err)
 		}
-		if openRouterAPIKey == "" {
-			openRouterAPIKey = os.Getenv("OPENROUTER_API_KEY")
+		capabilitiesData = data
+	}
+	if err := json.Unmarshal(capabilitiesData, &modelCapabilities); err != nil {
+		log.Fatalf("Error parsing model capabilities: %v", err)
+	}
+	capabilityRefreshInterval = time.Duration(envInt("CAPABILITY_REFRESH_INTERVAL", 3600)) * time.Second
+
+	keyRateLimits = make(map[string]int)
+	for key, value := range parseKeyValues(os.Getenv("KEY_RATE_LIMITS")) {
+		rpm, err := strconv.Atoi(value)
+		if err != nil || rpm <= 0 {
+			log.Fatalf("Invalid KEY_RATE_LIMITS entry for key %s: %q", maskAPIKey(key), value)
 		}
-		if defaultModel == "" {
-			defaultModel = os.Getenv("OPENROUTER_MODEL")
+		keyRateLimits[key] = rpm
+	}
+	globalRateLimit = envFloat("RATE_LIMIT_RPS", 0)
+	if globalRateLimit > 0 {
+		sharedLimiter = rate.NewLimiter(rate.Limit(globalRateLimit), int(math.Ceil(globalRateLimit)))
+	}
+	tokenBudgets = loadTokenBudgets()
+	modelPrices = make(map[string]modelPrice)
+	for model, value := range parseKeyValues(os.Getenv("MODEL_PRICES")) {
+		price, ok := parseModelPrice(value)
+		if !ok {
+			log.Fatalf("Invalid MODEL_PRICES entry for model %s: %q", model, value)
 		}
+		modelPrices[normalizeModelID(model)] = price
+	}
+	costBudgetUSD = envFloat("COST_BUDGET_USD", 0)
+	costAlertThresholdPercent = envFloat("COST_ALERT_THRESHOLD_PERCENT", 80)
+	alertWebhookURL = os.Getenv("ALERT_WEBHOOK_URL")
+
+	ignoreParallelToolCallsProviders = splitList(os.Getenv("IGNORE_PARALLEL_TOOL_CALLS_PROVIDERS"))
+	if providers := splitList(os.Getenv("TOOL_CHOICE_PASSTHROUGH_PROVIDERS")); len(providers) > 0 {
+		toolChoicePassthroughProviders = providers
+	}
+	countStreamTokensProviders = splitList(os.Getenv("COUNT_STREAM_TOKENS_MODEL"))
+	if sentinels := splitList(os.Getenv("DONE_SENTINELS")); len(sentinels) > 0 {
+		doneSentinels = sentinels
 	}
 
-	// Ensure API key is provided and has correct format
-	if !strings.HasPrefix(openRouterAPIKey, "sk-or-") {
-		log.Fatal("OPENROUTER_API_KEY must start with 'sk-or-'")
+	if model := os.Getenv("CURSOR_MOCKED_MODEL"); model != "" {
+		cursorMockedModel = model
 	}
-	if len(openRouterAPIKey) < 32 {
-		log.Fatal("OPENROUTER_API_KEY seems too short to be valid")
+	cursorMockedModels = append(splitList(os.Getenv("CURSOR_MOCKED_MODELS")), cursorMockedModel)
+
+	// Resolve short model names before validation
+	modelAliases = make(map[string]string)
+	for alias, model := range parseKeyValues(os.Getenv("MODEL_ALIASES")) {
+		modelAliases[normalizeModelID(alias)] = model
 	}
+	defaultModel = resolveAlias(defaultModel, modelAliases)
 
 	// Validate or fallback to default model
 	if defaultModel == "" {
@@ -123,14 +668,203 @@ func init() {
 		log.Fatalf("Invalid model: %s. Must contain a provider prefix (e.g. openai/gpt-4o)", defaultModel)
 	}
 
+	var fallbackModels []string
+	for _, model := range splitList(os.Getenv("OPENROUTER_FALLBACK_MODELS")) {
+		fallbackModels = append(fallbackModels, resolveAlias(model, modelAliases))
+	}
+
+	tenantDir = os.Getenv("TENANT_DIR")
+	sniTenants = make(map[string]string)
+	for host, path := range parseKeyValues(os.Getenv("SNI_TENANT_MAP")) {
+		sniTenants[strings.ToLower(host)] = path
+	}
+
+	semaphore = make(chan struct{}, envInt("MAX_CONCURRENT_REQUESTS", 50))
+
+	upstreamMaxRetries = envInt("UPSTREAM_MAX_RETRIES", 2)
+	retryAfterCap = time.Duration(envInt("RETRY_AFTER_CAP_SECONDS", 60)) * time.Second
+	strategy, err := newRetryStrategy(os.Getenv("RETRY_STRATEGY"),
+		envDuration("RETRY_BASE_DELAY", 500*time.Millisecond), envDuration("RETRY_MAX_DELAY", 30*time.Second))
+	if err != nil {
+		log.Fatalf("Invalid RETRY_STRATEGY: %v", err)
+	}
+	retryStrategy = retryAfterStrategy{next: strategy}
+
+	stripResponseFields = splitList(os.Getenv("STRIP_RESPONSE_FIELDS"))
+
+	webhookURL = os.Getenv("WEBHOOK_URL")
+	if text := os.Getenv("WEBHOOK_TEMPLATE"); text != "" {
+		tmpl, err := template.New("webhook").Parse(text)
+		if err != nil {
+			log.Fatalf("Invalid WEBHOOK_TEMPLATE: %v", err)
+		}
+		webhookTemplate = tmpl
+	}
+
+	fileConfig := loadProxyFile()
+	routingRules = compileRoutingRules(fileConfig.RoutingRules)
+	modelHeaders = make(map[string]map[string]string)
+	for model, headers := range fileConfig.ModelHeaders {
+		modelHeaders[normalizeModelID(model)] = headers
+	}
+	deprecatedModels = make(map[string]ModelDeprecation)
+	for model, deprecation := range fileConfig.DeprecatedModels {
+		deprecatedModels[normalizeModelID(model)] = deprecation
+	}
+
+	systemPrompt = fileConfig.SystemPrompt
+	if value := os.Getenv("SYSTEM_PROMPT"); value != "" {
+		systemPrompt = value
+	}
+	if systemPrompt != "" {
+		tmpl, err := template.New("system_prompt").Parse(systemPrompt)
+		if err != nil {
+			log.Printf("Warning: system prompt is not a valid template, sending it as-is: %v", err)
+		} else {
+			systemPromptTemplate = tmpl
+		}
+	}
+	templateVars = parseKeyValues(os.Getenv("TEMPLATE_VARS"))
+
+	if value := os.Getenv("LATENCY_ROUTING_MODELS"); value != "" {
+		var models []string
+		for _, model := range splitList(value) {
+			model = resolveAlias(model, modelAliases)
+			if !strings.Contains(model, "/") {
+				log.Fatalf("Invalid LATENCY_ROUTING_MODELS model %q: must contain a provider prefix", model)
+			}
+			models = append(models, model)
+		}
+		latencyRouter = newLatencyTracker(models)
+	}
+
+	if value := os.Getenv("OPENROUTER_PROVIDER_PREFERENCES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &defaultProviderPreferences); err != nil {
+			log.Fatalf("Invalid OPENROUTER_PROVIDER_PREFERENCES: %v", err)
+		}
+	}
+
+	defaultTransforms = splitList(os.Getenv("OPENROUTER_TRANSFORMS"))
+	defaultRoute = os.Getenv("OPENROUTER_ROUTE")
+	if !validRoute(defaultRoute) {
+		log.Printf("Warning: ignoring invalid OPENROUTER_ROUTE %q (use fallback)", defaultRoute)
+		defaultRoute = ""
+	}
+
+	tools, err := parseBuiltinTools(os.Getenv("BUILTIN_TOOLS"))
+	if err != nil {
+		log.Fatalf("Invalid BUILTIN_TOOLS: %v", err)
+	}
+	builtinTools = tools
+	maxToolRounds = envInt("MAX_TOOL_ROUNDS", maxToolRounds)
+
+	var defaultSelector *weightedSelector
+	if value := os.Getenv("OPENROUTER_MODELS"); value != "" {
+		selector, err := newWeightedSelector(value)
+		if err != nil {
+			log.Fatalf("Invalid OPENROUTER_MODELS: %v", err)
+		}
+		defaultSelector = selector
+		log.Printf("Routing requests across weighted models: %s", value)
+	}
+
+	largeResponseThreshold = int64(envInt("LARGE_RESPONSE_THRESHOLD", 1<<20))
+	benchmarkTimeout = envDuration("BENCHMARK_TIMEOUT", benchmarkTimeout)
+	latencyWindowSize = envInt("LATENCY_WINDOW_SIZE", latencyWindowSize)
+	keyRefreshURL = os.Getenv("KEY_REFRESH_URL")
+	streamChunkTimeout = envDuration("STREAM_CHUNK_TIMEOUT", streamChunkTimeout)
+	progressIntervalTokens = envInt("PROGRESS_INTERVAL_TOKENS", 0)
+	slowRequestThreshold = time.Duration(envInt("SLOW_REQUEST_THRESHOLD_MS", 0)) * time.Millisecond
+	maxMessages = envInt("MAX_MESSAGES", 0)
+	truncateStrategy = os.Getenv("TRUNCATE_STRATEGY")
+	if !validTruncateStrategy(truncateStrategy) {
+		log.Fatalf("Invalid TRUNCATE_STRATEGY %q: use oldest_first or summarize", truncateStrategy)
+	}
+	configHistorySize = envInt("CONFIG_HISTORY_SIZE", configHistorySize)
+	idempotencyTTL = envDuration("IDEMPOTENCY_TTL", idempotencyTTL)
+	deduplicationWait = envDuration("DEDUPLICATION_WAIT_TIMEOUT", deduplicationWait)
+	switch value := os.Getenv("DEFAULT_FINISH_REASON"); value {
+	case "":
+	case "none":
+		defaultFinishReason = ""
+	default:
+		defaultFinishReason = value
+	}
+	batchConcurrency = envInt("BATCH_CONCURRENCY", batchConcurrency)
+	batchTimeout = envDuration("BATCH_TIMEOUT", batchTimeout)
+
+	invalidChunkThreshold = envInt("INVALID_CHUNK_THRESHOLD", invalidChunkThreshold)
+
+	bufferSmallThreshold = envInt("BUFFER_SMALL_THRESHOLD", bufferSmallThreshold)
+	bufferLargeInitialSize = envInt("BUFFER_LARGE_INITIAL_SIZE", bufferLargeInitialSize)
+
+	if mockMode {
+		log.Printf("Warning: MOCK_MODE is enabled, upstream calls return canned responses")
+		httpClient = &http.Client{Transport: newMockTransport()}
+	} else {
+		httpClient = newHTTPClient()
+	}
+
 	// Configure the active endpoint and model
-	activeConfig = Config{
-		endpoint: openRouterEndpoint,
-		model:    defaultModel,
-		apiKey:   openRouterAPIKey,
+	userAgent := os.Getenv("PROXY_USER_AGENT")
+	if userAgent == "" {
+		userAgent = "cursor-proxy/1.0"
+	}
+	if os.Getenv("APPEND_GO_VERSION") == "true" {
+		userAgent += "/" + runtime.Version()
+	}
+
+	referer := os.Getenv("OPENROUTER_REFERER")
+	if referer == "" {
+		referer = "https://github.com/pezzos/cursor-proxy"
+	}
+	title := os.Getenv("OPENROUTER_TITLE")
+	if title == "" {
+		title = "Cursor Proxy"
+	}
+
+	defaultConfig := Config{
+		endpoint:  openRouterEndpoint,
+		model:     defaultModel,
+		apiKey:    openRouterAPIKey,
+		userAgent: userAgent,
+		referer:   referer,
+		title:     title,
+	}
+	activeState.Store(&configState{
+		config:         defaultConfig,
+		name:           "default",
+		selector:       defaultSelector,
+		fallbackModels: fallbackModels,
+	})
+	recordConfigChange("startup", "env")
+
+	namedConfigs = make(map[string]namedConfig)
+	for name, named := range fileConfig.NamedConfigs {
+		resolved := namedConfig{config: defaultConfig, fallbackModels: fallbackModels}
+		resolved.config.model = resolveAlias(named.Model, modelAliases)
+		if !strings.Contains(resolved.config.model, "/") {
+			log.Fatalf("Invalid named config %s: model %q must contain a provider prefix", name, named.Model)
+		}
+		if named.Endpoint != "" {
+			resolved.config.endpoint = strings.TrimSuffix(named.Endpoint, "/")
+		}
+		if named.APIKey != "" {
+			resolved.config.apiKey = named.APIKey
+		}
+		if len(named.FallbackModels) > 0 {
+			resolved.fallbackModels = nil
+			for _, model := range named.FallbackModels {
+				resolved.fallbackModels = append(resolved.fallbackModels, resolveAlias(model, modelAliases))
+			}
+		}
+		namedConfigs[name] = resolved
 	}
 
-	log.Printf("Initialized Cursor-OpenRouter proxy with model: %s using endpoint: %s", activeConfig.model, activeConfig.endpoint)
+	log.Printf("Initialized Cursor-OpenRouter proxy with model: %s using endpoint: %s (key: %s)", defaultConfig.model, defaultConfig.endpoint, maskAPIKey(defaultConfig.apiKey))
+	if deprecation, ok := deprecatedModels[defaultConfig.model]; ok {
+		log.Printf("Warning: %s", deprecation.Warning(defaultConfig.model))
+	}
 }
 
 // Models response structure
@@ -148,22 +882,192 @@ type Model struct {
 
 // OpenAI compatible request structure
 type ChatRequest struct {
-	Model       string      `json:"model"`
-	Messages    []Message   `json:"messages"`
-	Stream      bool        `json:"stream"`
-	Functions   []Function  `json:"functions,omitempty"`
-	Tools       []Tool      `json:"tools,omitempty"`
-	ToolChoice  interface{} `json:"tool_choice,omitempty"`
-	Temperature *float64    `json:"temperature,omitempty"`
-	MaxTokens   *int        `json:"max_tokens,omitempty"`
+	Model             string         `json:"model"`
+	Messages          []Message      `json:"messages"`
+	Stream            bool           `json:"stream"`
+	Functions         []Function     `json:"functions,omitempty"`
+	Tools             []Tool         `json:"tools,omitempty"`
+	ToolChoice        interface{}    `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool          `json:"parallel_tool_calls,omitempty"`
+	Temperature       *float64       `json:"temperature,omitempty"`
+	TopP              *float64       `json:"top_p,omitempty"`
+	MaxTokens         *int           `json:"max_tokens,omitempty"`
+	StreamOptions     *StreamOptions `json:"stream_options,omitempty"`
+
+	// OpenRouter provider routing, for clients that know about it
+	Provider *ProviderPreferences `json:"provider,omitempty"`
+
+	// OpenRouter prompt transforms (e.g. middle-out), replacing the
+	// OPENROUTER_TRANSFORMS default
+	Transforms []string `json:"transforms,omitempty"`
+
+	// OpenRouter routing mode, "fallback" or empty, replacing the
+	// OPENROUTER_ROUTE default
+	Route string `json:"route,omitempty"`
+}
+
+// ProviderPreferences is OpenRouter's provider routing object
+type ProviderPreferences struct {
+	Order             []string `json:"order,omitempty"`
+	AllowFallbacks    *bool    `json:"allow_fallbacks,omitempty"`
+	RequireParameters *bool    `json:"require_parameters,omitempty"`
+	DataCollection    *string  `json:"data_collection,omitempty"`
+	Sort              string   `json:"sort,omitempty"`
+}
+
+// mergeProviderPreferences returns base with the fields set in override
+// replaced; either may be nil
+func mergeProviderPreferences(base, override *ProviderPreferences) *ProviderPreferences {
+	if override == nil {
+		return base
+	}
+	if base == nil {
+		return override
+	}
+	merged := *base
+	if override.Order != nil {
+		merged.Order = override.Order
+	}
+	if override.AllowFallbacks != nil {
+		merged.AllowFallbacks = override.AllowFallbacks
+	}
+	if override.RequireParameters != nil {
+		merged.RequireParameters = override.RequireParameters
+	}
+	if override.DataCollection != nil {
+		merged.DataCollection = override.DataCollection
+	}
+	if override.Sort != "" {
+		merged.Sort = override.Sort
+	}
+	return &merged
+}
+
+// defaultProviderPreferences applies to every request
+// (OPENROUTER_PROVIDER_PREFERENCES)
+var defaultProviderPreferences *ProviderPreferences
+
+// defaultTransforms are the OpenRouter prompt transforms of requests that
+// name none (OPENROUTER_TRANSFORMS)
+var defaultTransforms []string
+
+// defaultRoute is the OpenRouter routing mode of requests that name none
+// (OPENROUTER_ROUTE)
+var defaultRoute string
+
+// validRoute reports whether route is an OpenRouter routing mode
+func validRoute(route string) bool {
+	return route == "" || route == "fallback"
+}
+
+// StreamOptions controls extra data sent on streaming responses
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type Message struct {
-	Role       string     `json:"role"`
-	Content    string     `json:"content"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
-	Name       string     `json:"name,omitempty"`
+	Role       string       `json:"role"`
+	Content    ContentField `json:"content"`
+	ToolCalls  []ToolCall   `json:"tool_calls,omitempty"`
+	ToolCallID string       `json:"tool_call_id,omitempty"`
+	Name       string       `json:"name,omitempty"`
+
+	// Reasoning of o1 and extended-thinking models, passed through unless
+	// STRIP_REASONING is set
+	Thinking         string `json:"thinking,omitempty"`
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+}
+
+// ContentField holds message content, which can be either a plain string or
+// an array of typed parts (text, image_url, multi-part tool results...).
+// Parts is nil when the content was sent as a plain string.
+type ContentField struct {
+	Text  string
+	Parts []ContentPart
+}
+
+// ContentPart is a single entry of an array content. Fields other than type
+// and text are kept verbatim in Extra so they round-trip unchanged.
+type ContentPart struct {
+	Type  string
+	Text  string
+	Extra map[string]json.RawMessage
+}
+
+func (c *ContentField) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		c.Text = ""
+		return json.Unmarshal(trimmed, &c.Parts)
+	}
+	c.Parts = nil
+	if bytes.Equal(trimmed, []byte("null")) {
+		c.Text = ""
+		return nil
+	}
+	return json.Unmarshal(trimmed, &c.Text)
+}
+
+func (c ContentField) MarshalJSON() ([]byte, error) {
+	if c.Parts != nil {
+		return json.Marshal(c.Parts)
+	}
+	return json.Marshal(c.Text)
+}
+
+// String returns the textual content, concatenating text parts for array content
+func (c ContentField) String() string {
+	if c.Parts == nil {
+		return c.Text
+	}
+	var sb strings.Builder
+	for _, part := range c.Parts {
+		if part.Text == "" {
+			continue
+		}
+		if sb.Len() > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(part.Text)
+	}
+	return sb.String()
+}
+
+func (p *ContentPart) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	p.Type, p.Text = "", ""
+	if raw, ok := fields["type"]; ok {
+		if err := json.Unmarshal(raw, &p.Type); err != nil {
+			return err
+		}
+		delete(fields, "type")
+	}
+	if raw, ok := fields["text"]; ok {
+		if err := json.Unmarshal(raw, &p.Text); err != nil {
+			return err
+		}
+		delete(fields, "text")
+	}
+	p.Extra = nil
+	if len(fields) > 0 {
+		p.Extra = fields
+	}
+	return nil
+}
+
+func (p ContentPart) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(p.Extra)+2)
+	for k, v := range p.Extra {
+		fields[k] = v
+	}
+	fields["type"] = p.Type
+	if p.Text != "" || p.Type == "text" {
+		fields["text"] = p.Text
+	}
+	return json.Marshal(fields)
 }
 
 type Function struct {
@@ -186,38 +1090,98 @@ type ToolCall struct {
 	} `json:"function"`
 }
 
-func convertToolChoice(choice interface{}) string {
+// toolChoiceNone is the tool_choice disabling tool calls
+var toolChoiceNone = json.RawMessage(`"none"`)
+
+// convertToolChoice returns the tool_choice sent to OpenRouter for model, nil
+// to omit it
+func convertToolChoice(choice interface{}, model string) json.RawMessage {
 	if choice == nil {
-		return ""
+		return nil
 	}
 
 	// If string "auto" or "none"
 	if str, ok := choice.(string); ok {
 		switch str {
 		case "auto", "none":
-			return str
+			encoded, _ := json.Marshal(str)
+			return encoded
 		}
 	}
 
 	// Try to parse as map for function call
 	if choiceMap, ok := choice.(map[string]interface{}); ok {
 		if choiceMap["type"] == "function" {
-			return "auto" // DeepSeek doesn't support specific function selection, default to auto
+			// Specific function selection only goes to the providers known
+			// to support it; others such as DeepSeek default to auto
+			if providerIn(model, toolChoicePassthroughProviders) {
+				if encoded, err := json.Marshal(choiceMap); err == nil {
+					return encoded
+				}
+			}
+			return json.RawMessage(`"auto"`)
 		}
 	}
 
-	return ""
+	return nil
 }
 
-func convertMessages(messages []Message) []Message {
-	converted := make([]Message, len(messages))
-	for i, msg := range messages {
-		log.Printf("Converting message %d - Role: %s", i, msg.Role)
-		converted[i] = msg
+// validTruncateStrategy reports whether strategy is a TRUNCATE_STRATEGY value
+func validTruncateStrategy(strategy string) bool {
+	switch strategy {
+	case "", "oldest_first", "summarize":
+		return true
+	}
+	return false
+}
+
+// truncateMessages keeps a leading system message and the most recent
+// messages of the conversation, limit in all, and returns them with the number
+// of messages removed. Tool results whose call was removed go too, as
+// providers reject them. With the summarize strategy, the oldest kept
+// non-system message starts with a note of the removal.
+func truncateMessages(messages []Message, limit int, strategy string) ([]Message, int) {
+	if limit <= 0 || len(messages) <= limit {
+		return messages, 0
+	}
+	var kept []Message
+	rest := messages
+	if messages[0].Role == "system" {
+		kept = append(kept, messages[0])
+		rest = messages[1:]
+	}
+	if keep := limit - len(kept); len(rest) > keep {
+		rest = rest[len(rest)-keep:]
+	}
+	for len(rest) > 0 && rest[0].Role == "tool" {
+		rest = rest[1:]
+	}
+	removed := len(messages) - len(kept) - len(rest)
+	kept = append(kept, rest...)
+
+	if strategy == "summarize" && len(rest) > 0 {
+		first := &kept[len(kept)-len(rest)]
+		note := fmt.Sprintf("[context truncated: %d messages removed]", removed)
+		if first.Content.Parts != nil {
+			first.Content.Parts = append([]ContentPart{{Type: "text", Text: note}}, first.Content.Parts...)
+		} else if first.Content.Text != "" {
+			first.Content.Text = note + "\n\n" + first.Content.Text
+		} else {
+			first.Content.Text = note
+		}
+	}
+	return kept, removed
+}
+
+func convertMessages(messages []Message) []Message {
+	converted := make([]Message, len(messages))
+	for i, msg := range messages {
+		debugLog("Converting message %d - Role: %s", i, msg.Role)
+		converted[i] = msg
 
 		// Handle assistant messages with tool calls
 		if msg.Role == "assistant" && len(msg.ToolCalls) > 0 {
-			log.Printf("Processing assistant message with %d tool calls", len(msg.ToolCalls))
+			debugLog("Processing assistant message with %d tool calls", len(msg.ToolCalls))
 			// DeepSeek expects tool_calls in a specific format
 			toolCalls := make([]ToolCall, len(msg.ToolCalls))
 			for j, tc := range msg.ToolCalls {
@@ -226,718 +1190,6001 @@ func convertMessages(messages []Message) []Message {
 					Type:     "function",
 					Function: tc.Function,
 				}
-				log.Printf("Tool call %d - ID: %s, Function: %s", j, tc.ID, tc.Function.Name)
+				debugLog("Tool call %d - ID: %s, Function: %s", j, tc.ID, tc.Function.Name)
 			}
 			converted[i].ToolCalls = toolCalls
 		}
 
 		// Handle function response messages
 		if msg.Role == "function" {
-			log.Printf("Converting function response to tool response")
+			debugLog("Converting function response to tool response")
 			// Convert to tool response format
 			converted[i].Role = "tool"
 		}
+
+		// Multi-part tool results are forwarded as an array; parts without a
+		// type are assumed to be text so strict providers accept them
+		if converted[i].Role == "tool" && msg.Content.Parts != nil {
+			debugLog("Tool response %d has %d content parts", i, len(msg.Content.Parts))
+			parts := make([]ContentPart, len(msg.Content.Parts))
+			for j, part := range msg.Content.Parts {
+				if part.Type == "" {
+					part.Type = "text"
+				}
+				parts[j] = part
+			}
+			converted[i].Content = ContentField{Parts: parts}
+		}
 	}
 
 	// Log the final converted messages
 	for i, msg := range converted {
-		log.Printf("Final message %d - Role: %s, Content: %s", i, msg.Role, truncateString(msg.Content, 50))
+		debugLog("Final message %d - Role: %s, Content: %s", i, msg.Role, logContent(msg.Content))
 		if len(msg.ToolCalls) > 0 {
-			log.Printf("Message %d has %d tool calls", i, len(msg.ToolCalls))
+			debugLog("Message %d has %d tool calls", i, len(msg.ToolCalls))
 		}
 	}
 
 	return converted
 }
 
-func truncateString(s string, maxLen int) string {
-	if len(s) <= maxLen {
-		return s
-	}
-	return s[:maxLen] + "..."
-}
-
-// Convert to OpenRouter request format
-type OpenRouterRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Tools       []Tool    `json:"tools,omitempty"`
-	ToolChoice  string    `json:"tool_choice,omitempty"`
+// roleNormalizers adapt the message roles of a request to what a provider
+// accepts, keyed by provider prefix
+var roleNormalizers = map[string]func([]Message) []Message{
+	"anthropic": normalizeAnthropicRoles,
+	"google":    normalizeGeminiRoles,
 }
 
-func debugLog(format string, args ...interface{}) {
-	if debugMode {
-		log.Printf(format, args...)
+// roleNormalizerForProvider returns the role normalizer of provider, or one
+// returning the messages unchanged
+func roleNormalizerForProvider(provider string) func([]Message) []Message {
+	if normalize, ok := roleNormalizers[provider]; ok {
+		return normalize
 	}
+	return func(messages []Message) []Message { return messages }
 }
 
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
-
-	// Add health check endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		// Test OpenRouter connection
-		req, err := http.NewRequest("GET", openRouterEndpoint+"/models", nil)
-		if err != nil {
-			log.Printf("Error creating health check request: %v", err)
-			http.Error(w, "Error creating request", http.StatusInternalServerError)
-			return
+// normalizeAnthropicRoles drops roles Anthropic does not know, merges
+// consecutive user messages and makes sure the conversation starts with a
+// user message after the system prompt
+func normalizeAnthropicRoles(messages []Message) []Message {
+	var normalized []Message
+	for _, msg := range messages {
+		switch msg.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			debugLog("Dropping %s message unsupported by Anthropic", msg.Role)
+			continue
+		}
+		if last := len(normalized) - 1; msg.Role == "user" && last >= 0 && normalized[last].Role == "user" {
+			normalized[last].Content = mergeContent(normalized[last].Content, msg.Content)
+			continue
 		}
+		normalized = append(normalized, msg)
+	}
 
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", activeConfig.apiKey))
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("HTTP-Referer", "https://github.com/pezzos/cursor-proxy")
-		req.Header.Set("X-Title", "Cursor Proxy")
-		req.Header.Set("OpenAI-Organization", "cursor-proxy")
+	first := 0
+	for first < len(normalized) && normalized[first].Role == "system" {
+		first++
+	}
+	if first < len(normalized) && normalized[first].Role != "user" {
+		debugLog("Inserting a user message before the first %s message for Anthropic", normalized[first].Role)
+		normalized = append(normalized[:first], append([]Message{{Role: "user", Content: ContentField{Text: "(start of conversation)"}}}, normalized[first:]...)...)
+	}
+	return normalized
+}
 
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			log.Printf("Health check failed: %v", err)
-			http.Error(w, "Connection failed", http.StatusServiceUnavailable)
-			return
+// normalizeGeminiRoles merges the system messages into one leading system
+// message. Gemini takes a single system instruction, which OpenRouter builds
+// from the system messages; the chat completions API has no separate field
+// for it.
+func normalizeGeminiRoles(messages []Message) []Message {
+	var system *Message
+	var others []Message
+	for _, msg := range messages {
+		if msg.Role != "system" {
+			others = append(others, msg)
+			continue
 		}
-		defer resp.Body.Close()
+		if system == nil {
+			merged := msg
+			system = &merged
+		} else {
+			system.Content = mergeContent(system.Content, msg.Content)
+		}
+	}
+	if system == nil {
+		return messages
+	}
+	return append([]Message{*system}, others...)
+}
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			log.Printf("Health check failed with status %d: %s", resp.StatusCode, string(body))
-			http.Error(w, fmt.Sprintf("OpenRouter returned %d", resp.StatusCode), resp.StatusCode)
-			return
+// mergeContent appends b to a, as parts when either of them has parts
+func mergeContent(a, b ContentField) ContentField {
+	if a.Parts == nil && b.Parts == nil {
+		return ContentField{Text: a.Text + "\n\n" + b.Text}
+	}
+	var parts []ContentPart
+	for _, content := range []ContentField{a, b} {
+		if content.Parts != nil {
+			parts = append(parts, content.Parts...)
+		} else if content.Text != "" {
+			parts = append(parts, ContentPart{Type: "text", Text: content.Text})
 		}
+	}
+	return ContentField{Parts: parts}
+}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{
-			"status":   "ok",
-			"endpoint": openRouterEndpoint,
-		})
-	})
+// sanitizeForLog returns a copy of req with message contents and tool call
+// arguments redacted, unless LOG_PII is enabled
+func sanitizeForLog(req ChatRequest) ChatRequest {
+	if logPII {
+		return req
+	}
 
-	server := &http.Server{
-		Addr:    ":9000",
-		Handler: http.HandlerFunc(proxyHandler),
+	sanitized := req
+	sanitized.Messages = make([]Message, len(req.Messages))
+	for i, msg := range req.Messages {
+		msg.Content = ContentField{Text: fmt.Sprintf("[redacted %d chars]", len(msg.Content.String()))}
+		if len(msg.ToolCalls) > 0 {
+			toolCalls := make([]ToolCall, len(msg.ToolCalls))
+			copy(toolCalls, msg.ToolCalls)
+			for j := range toolCalls {
+				toolCalls[j].Function.Arguments = "[redacted]"
+			}
+			msg.ToolCalls = toolCalls
+		}
+		sanitized.Messages[i] = msg
 	}
+	return sanitized
+}
 
-	// Enable HTTP/2 support
-	http2.ConfigureServer(server, &http2.Server{})
+// logContent returns a loggable preview of a message content
+func logContent(content ContentField) string {
+	if !logPII {
+		return fmt.Sprintf("[redacted %d chars]", len(content.String()))
+	}
+	return truncateString(content.String(), 50)
+}
 
-	log.Printf("Starting proxy server on %s", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+func truncateString(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
 	}
+	return s[:maxLen] + "..."
 }
 
-func enableCors(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Content-Length")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
+// Convert to OpenRouter request format
+type OpenRouterRequest struct {
+	Model             string          `json:"model"`
+	Messages          []Message       `json:"messages"`
+	Stream            bool            `json:"stream"`
+	Temperature       float64         `json:"temperature,omitempty"`
+	TopP              float64         `json:"top_p,omitempty"`
+	MaxTokens         int             `json:"max_tokens,omitempty"`
+	Tools             []Tool          `json:"tools,omitempty"`
+	ToolChoice        json.RawMessage `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	StreamOptions     *StreamOptions  `json:"stream_options,omitempty"`
+
+	ProviderPreferences *ProviderPreferences `json:"provider,omitempty"`
+	Transforms          []string             `json:"transforms,omitempty"`
+	Route               string               `json:"route,omitempty"`
 }
 
-func maskAPIKey(key string) string {
-	if len(key) <= 12 {
-		return "***"
+// splitList parses a comma-separated env value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return key[:6] + "..." + key[len(key)-6:]
+	return items
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	debugLog("Received request: %s %s", r.Method, r.URL.Path)
+// TenantConfig is read from <TENANT_DIR>/<tenant-id>.yaml, or from the file
+// SNI_TENANT_MAP assigns to a hostname
+type TenantConfig struct {
+	APIKey         string   `yaml:"api_key"`
+	Model          string   `yaml:"model"`
+	FallbackModels []string `yaml:"fallback_models"`
 
-	if r.Method == "OPTIONS" {
-		enableCors(w)
-		return
-	}
+	// Certificate served to clients connecting with the tenant hostname,
+	// only used for SNI tenants
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
 
-	enableCors(w)
+	tlsCert *tls.Certificate
+}
 
-	// Handle /v1/config endpoint for GET
-	if r.URL.Path == "/v1/config" && r.Method == "GET" {
-		handleGetConfigRequest(w, r)
-		return
-	}
+var (
+	tenantDir     string
+	tenantConfigs sync.Map
+	validTenantID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
 
-	// Handle /v1/models endpoint
-	if r.URL.Path == "/v1/models" && r.Method == "GET" {
-		handleGetModelsRequest(w)
-		return
-	}
+	// Tenant files by lowercase hostname, from SNI_TENANT_MAP
+	sniTenants map[string]string
+)
 
-	// Handle /v1/config endpoint for POST
-	if r.URL.Path == "/v1/config" && r.Method == "POST" {
-		handleConfigRequest(w, r)
-		return
+// tenantConfigFor returns the validated configuration of a tenant, loading
+// it on first use
+func tenantConfigFor(tenantID string) (*TenantConfig, error) {
+	if cached, ok := tenantConfigs.Load(tenantID); ok {
+		return cached.(*TenantConfig), nil
 	}
-
-	// Only handle API requests with /v1/ prefix
-	if !strings.HasPrefix(r.URL.Path, "/v1/") {
-		log.Printf("Invalid path: %s", r.URL.Path)
-		http.Error(w, "Not found", http.StatusNotFound)
-		return
+	if !validTenantID.MatchString(tenantID) {
+		return nil, fmt.Errorf("invalid tenant ID")
 	}
 
-	// Validate API key
-	authHeader := r.Header.Get("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		debugLog("Missing or invalid Authorization header")
-		http.Error(w, "Missing or invalid Authorization header", http.StatusUnauthorized)
-		return
+	tenant, err := loadTenantFile(filepath.Join(tenantDir, tenantID+".yaml"))
+	if err != nil {
+		return nil, err
 	}
+	tenantConfigs.Store(tenantID, tenant)
+	log.Printf("Loaded tenant %s (model: %s, key: %s)", tenantID, tenant.Model, maskAPIKey(tenant.APIKey))
+	return tenant, nil
+}
 
-	// Only check that the key has a valid format (sk-* or Bearer *)
-	userAPIKey := strings.TrimPrefix(authHeader, "Bearer ")
-	if !strings.HasPrefix(strings.TrimSpace(userAPIKey), "sk-") {
-		log.Printf("Invalid API key format")
-		http.Error(w, "Invalid API key format", http.StatusUnauthorized)
-		return
+// sniTenantFor returns the configuration of the SNI_TENANT_MAP tenant
+// serving host, or nil when the host has none. Configurations share the
+// tenant cache, keyed by file path.
+func sniTenantFor(host string) (*TenantConfig, error) {
+	path, ok := sniTenants[strings.ToLower(host)]
+	if !ok {
+		return nil, nil
+	}
+	key := "file:" + path
+	if cached, ok := tenantConfigs.Load(key); ok {
+		return cached.(*TenantConfig), nil
 	}
 
-	// Read and log request body for debugging
-	var chatReq ChatRequest
-	body, err := io.ReadAll(r.Body)
+	tenant, err := loadTenantFile(path)
 	if err != nil {
-		debugLog("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusBadRequest)
-		return
+		return nil, err
 	}
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-
-	if err := json.Unmarshal(body, &chatReq); err != nil {
-		log.Printf("Error parsing request JSON: %v", err)
-		log.Printf("Raw request body: %s", string(body))
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+	if tenant.TLSCertFile != "" && tenant.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tenant.TLSCertFile, tenant.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		tenant.tlsCert = &cert
 	}
+	tenantConfigs.Store(key, tenant)
+	log.Printf("Loaded tenant for %s (model: %s, key: %s)", host, tenant.Model, maskAPIKey(tenant.APIKey))
+	return tenant, nil
+}
 
-	log.Printf("Parsed request: %+v", chatReq)
-
-	// Replace gpt-4o model with the appropriate model
-	if chatReq.Model == cursorMockedModel {
-		log.Printf("Converting gpt-4o to configured model: %s (endpoint: %s)", activeConfig.model, activeConfig.endpoint)
-		chatReq.Model = activeConfig.model
-		log.Printf("Model converted to: %s", activeConfig.model)
-	} else {
-		log.Printf("Unsupported model requested: %s", chatReq.Model)
-		http.Error(w, fmt.Sprintf("Model %s not supported. Use %s instead.", chatReq.Model, cursorMockedModel), http.StatusBadRequest)
-		return
+// loadTenantFile reads and validates a tenant configuration file
+func loadTenantFile(path string) (*TenantConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenant TenantConfig
+	if err := yaml.Unmarshal(data, &tenant); err != nil {
+		return nil, err
 	}
 
-	// Convert to OpenRouter request format with model-specific adjustments
-	openRouterReq := OpenRouterRequest{
-		Model:    activeConfig.model,
-		Messages: convertMessages(chatReq.Messages),
-		Stream:   chatReq.Stream,
+	if !strings.HasPrefix(tenant.APIKey, "sk-or-") || len(tenant.APIKey) < 32 {
+		return nil, errors.New("api_key must be a valid OpenRouter key (sk-or-...)")
+	}
+	tenant.Model = resolveAlias(tenant.Model, modelAliases)
+	if tenant.Model != "" && !strings.Contains(tenant.Model, "/") {
+		return nil, fmt.Errorf("invalid model %s: must contain a provider prefix", tenant.Model)
 	}
+	for i, model := range tenant.FallbackModels {
+		tenant.FallbackModels[i] = resolveAlias(model, modelAliases)
+	}
+	return &tenant, nil
+}
 
-	// Model-specific adjustments
-	switch {
-	case strings.HasPrefix(activeConfig.model, "mistralai/"):
-		if chatReq.Temperature != nil {
-			temp := *chatReq.Temperature
-			if temp > 1.0 {
-				temp = 1.0
-			}
-			openRouterReq.Temperature = temp
-		}
-	case strings.HasPrefix(activeConfig.model, "google/"):
-		if chatReq.Temperature != nil {
-			temp := *chatReq.Temperature
-			if temp > 1.0 {
-				temp = 1.0
-			}
-			openRouterReq.Temperature = temp
-		}
-		if chatReq.MaxTokens != nil {
-			openRouterReq.MaxTokens = *chatReq.MaxTokens
+type sniTenantKey struct{}
+
+// sniTenantMiddleware selects the SNI_TENANT_MAP tenant matching the TLS
+// server name, or the Host header on plain HTTP. Requests for unmapped hosts
+// use the default configuration.
+func sniTenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			host = r.TLS.ServerName
+		} else if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
 		}
-	default:
-		if chatReq.Temperature != nil {
-			openRouterReq.Temperature = *chatReq.Temperature
+
+		tenant, err := sniTenantFor(host)
+		if err != nil {
+			// Never fall back to the default key for a mapped host
+			reqLog(r.Context(), "Error loading tenant for %s: %v", host, err)
+			writeError(w, http.StatusInternalServerError, errTypeServer, "Tenant configuration unavailable")
+			return
 		}
-		if chatReq.MaxTokens != nil {
-			openRouterReq.MaxTokens = *chatReq.MaxTokens
+		if tenant != nil {
+			r = r.WithContext(context.WithValue(r.Context(), sniTenantKey{}, tenant))
 		}
-	}
+		next.ServeHTTP(w, r)
+	})
+}
 
-	// Handle tools/functions
-	if len(chatReq.Tools) > 0 {
-		openRouterReq.Tools = chatReq.Tools
-		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
-			openRouterReq.ToolChoice = tc
-		}
-	} else if len(chatReq.Functions) > 0 {
-		tools := make([]Tool, len(chatReq.Functions))
-		for i, fn := range chatReq.Functions {
-			tools[i] = Tool{
-				Type:     "function",
-				Function: fn,
-			}
+// sniTenantFrom returns the tenant selected by sniTenantMiddleware, if any
+func sniTenantFrom(ctx context.Context) *TenantConfig {
+	tenant, _ := ctx.Value(sniTenantKey{}).(*TenantConfig)
+	return tenant
+}
+
+// tenantTLSConfig returns a GetConfigForClient callback serving the
+// certificate of the SNI tenant when it has one. Other handshakes keep base,
+// which is read at handshake time so HTTP/2 negotiation settings apply.
+func tenantTLSConfig(base **tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		tenant, err := sniTenantFor(hello.ServerName)
+		if err != nil {
+			log.Printf("Warning: loading tenant for %s failed: %v", hello.ServerName, err)
+			return nil, nil
 		}
-		openRouterReq.Tools = tools
-		if tc := convertToolChoice(chatReq.ToolChoice); tc != "" {
-			openRouterReq.ToolChoice = tc
+		if tenant == nil || tenant.tlsCert == nil {
+			return nil, nil
 		}
+		config := (*base).Clone()
+		config.GetConfigForClient = nil
+		config.GetCertificate = nil
+		config.Certificates = []tls.Certificate{*tenant.tlsCert}
+		return config, nil
 	}
+}
 
-	// Create new request body
-	modifiedBody, err := json.Marshal(openRouterReq)
-	if err != nil {
-		log.Printf("Error creating modified request body: %v", err)
-		http.Error(w, "Error creating modified request", http.StatusInternalServerError)
-		return
-	}
+var (
+	// System message prepended to every request (SYSTEM_PROMPT or the
+	// system_prompt of proxy.yaml), expanded as a template when it parses
+	systemPrompt         string
+	systemPromptTemplate *template.Template
 
-	log.Printf("Modified request body: %s", string(modifiedBody))
+	// Extra template variables, from TEMPLATE_VARS
+	templateVars map[string]string
+)
 
-	// Create the proxy request to OpenRouter
-	targetURL := activeConfig.endpoint
-	if !strings.HasSuffix(targetURL, "/") {
-		targetURL += "/"
+// renderSystemPrompt expands the system prompt for a request. Besides the
+// TEMPLATE_VARS entries, templates can use .Date, .Model and .KeyPrefix
+// (the first 6 characters of the client key).
+func renderSystemPrompt(ctx context.Context, model, apiKey string) string {
+	if systemPromptTemplate == nil {
+		return systemPrompt
 	}
-	targetURL += strings.TrimPrefix(r.URL.Path, "/v1/")
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+
+	data := make(map[string]string, len(templateVars)+3)
+	for key, value := range templateVars {
+		data[key] = value
 	}
+	data["Date"] = time.Now().Format("2006-01-02")
+	data["Model"] = model
+	data["KeyPrefix"] = truncateKey(apiKey, 6)
 
-	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
-	if err != nil {
-		log.Printf("Error creating proxy request: %v", err)
-		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
-		return
+	var rendered strings.Builder
+	if err := systemPromptTemplate.Execute(&rendered, data); err != nil {
+		reqLog(ctx, "Warning: expanding the system prompt failed, sending it as-is: %v", err)
+		return systemPrompt
 	}
+	return rendered.String()
+}
 
-	// Set common headers
-	proxyReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", activeConfig.apiKey))
-	proxyReq.Header.Set("Content-Type", "application/json")
-	proxyReq.Header.Set("Accept", "application/json")
-	proxyReq.Header.Set("User-Agent", "cursor-proxy/1.0")
-	proxyReq.Header.Set("HTTP-Referer", "https://github.com/pezzos/cursor-proxy")
-	proxyReq.Header.Set("X-Title", "Cursor Proxy")
-	proxyReq.Header.Set("OpenAI-Organization", "cursor-proxy")
+// truncateKey returns the first n characters of key
+func truncateKey(key string, n int) string {
+	if len(key) <= n {
+		return key
+	}
+	return key[:n]
+}
 
-	// Model-specific headers
-	switch {
-	case strings.HasPrefix(activeConfig.model, "mistralai/"):
-		proxyReq.Header.Set("X-Model-Provider", "mistral")
-	case strings.HasPrefix(activeConfig.model, "google/"):
-		proxyReq.Header.Set("X-Model-Provider", "google")
+// ProxyFile is the optional YAML configuration file (PROXY_CONFIG_FILE,
+// proxy.yaml by default)
+type ProxyFile struct {
+	RoutingRules     []RoutingRuleConfig          `yaml:"routing_rules"`
+	DeprecatedModels map[string]ModelDeprecation  `yaml:"deprecated_models"`
+	SystemPrompt     string                       `yaml:"system_prompt"`
+	ModelHeaders     map[string]map[string]string `yaml:"model_headers"`
+	NamedConfigs     map[string]NamedConfig       `yaml:"named_configs"`
+}
+
+// NamedConfig is a preset of proxy.yaml activated through
+// /v1/config/activate. Empty fields keep the values from the environment.
+type NamedConfig struct {
+	Model          string   `yaml:"model" json:"model"`
+	FallbackModels []string `yaml:"fallback_models" json:"fallback_models,omitempty"`
+	Endpoint       string   `yaml:"endpoint" json:"endpoint,omitempty"`
+	APIKey         string   `yaml:"api_key" json:"api_key,omitempty"`
+}
+
+// namedConfig is a NamedConfig resolved against the environment
+type namedConfig struct {
+	config         Config
+	fallbackModels []string
+}
+
+var namedConfigs map[string]namedConfig
+
+// ModelDeprecation describes when a model was deprecated by OpenRouter and
+// what to use instead
+type ModelDeprecation struct {
+	DeprecatedAt string `yaml:"deprecated_at" json:"deprecated_at"`
+	Replacement  string `yaml:"replacement" json:"replacement"`
+}
+
+// Warning returns the text of the X-Proxy-Deprecation-Warning header
+func (d ModelDeprecation) Warning(model string) string {
+	warning := fmt.Sprintf("%s is deprecated since %s", model, d.DeprecatedAt)
+	if d.Replacement != "" {
+		warning += "; use " + d.Replacement + " instead"
 	}
+	return warning
+}
 
-	// Remove problematic headers
-	proxyReq.Header.Del("X-Forwarded-For")
-	proxyReq.Header.Del("X-Forwarded-Host")
-	proxyReq.Header.Del("X-Forwarded-Port")
-	proxyReq.Header.Del("X-Forwarded-Proto")
-	proxyReq.Header.Del("X-Forwarded-Server")
-	proxyReq.Header.Del("X-Real-Ip")
+var deprecatedModels map[string]ModelDeprecation
 
-	if chatReq.Stream {
-		proxyReq.Header.Set("Accept", "text/event-stream")
+// modelHeaders holds the extra upstream headers of model IDs and provider
+// prefixes ("anthropic/"), from the model_headers section of proxy.yaml
+var modelHeaders map[string]map[string]string
+
+// applyModelHeaders sets the headers configured for the provider of model,
+// then those of the exact model ID, which take precedence
+func applyModelHeaders(h http.Header, model string) {
+	provider := extractProvider(model)
+	for _, key := range []string{provider, provider + "/", model} {
+		for name, value := range modelHeaders[key] {
+			h.Set(name, value)
+		}
 	}
+}
 
-	resp, err := httpClient.Do(proxyReq)
+// RoutingRuleConfig sends requests whose messages match Pattern to Model
+type RoutingRuleConfig struct {
+	Pattern string `yaml:"pattern"`
+	Model   string `yaml:"model"`
+}
+
+type routingRule struct {
+	pattern *regexp.Regexp
+	model   string
+}
+
+var routingRules []routingRule
+
+// loadProxyFile reads PROXY_CONFIG_FILE, exiting when it cannot be parsed
+func loadProxyFile() ProxyFile {
+	config, path, err := readProxyFile()
 	if err != nil {
-		log.Printf("Error forwarding request: %v", err)
-		http.Error(w, "Error forwarding request", http.StatusBadGateway)
-		return
+		log.Fatal(err)
 	}
-	defer resp.Body.Close()
+	if path != "" {
+		log.Printf("Loaded configuration file %s", path)
+	}
+	return config
+}
 
-	log.Printf("OpenRouter response status: %d", resp.StatusCode)
-	log.Printf("OpenRouter response headers: %v", resp.Header)
+// readProxyFile reads PROXY_CONFIG_FILE and returns the path it was read
+// from. A missing proxy.yaml is not an error when the variable is unset.
+func readProxyFile() (ProxyFile, string, error) {
+	var config ProxyFile
+	path := os.Getenv("PROXY_CONFIG_FILE")
+	explicit := path != ""
+	if !explicit {
+		path = "proxy.yaml"
+	}
 
-	// Handle error responses with better error handling
-	if resp.StatusCode >= 400 {
-		respBody, err := readResponse(resp)
-		if err != nil {
-			log.Printf("Error reading error response: %v", err)
-			http.Error(w, "Error reading response", http.StatusInternalServerError)
-			return
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return config, "", nil
 		}
+		return config, path, fmt.Errorf("Error reading %s: %v", path, err)
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, path, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+	return config, path, nil
+}
 
-		log.Printf("Error response body: %s", string(respBody))
-
-		// Try to parse the error response
-		var openRouterErr struct {
-			Error struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Code    int    `json:"code"`
-			} `json:"error"`
+// compileRoutingRules compiles the routing rule patterns, exiting on an
+// invalid rule
+func compileRoutingRules(configs []RoutingRuleConfig) []routingRule {
+	var rules []routingRule
+	for _, rule := range configs {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Fatalf("Invalid routing rule pattern %q: %v", rule.Pattern, err)
 		}
-
-		if err := json.Unmarshal(respBody, &openRouterErr); err != nil {
-			// If we can't parse the error, return the raw response
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(resp.StatusCode)
-			w.Write(respBody)
-			return
+		model := resolveAlias(rule.Model, modelAliases)
+		if !strings.Contains(model, "/") {
+			log.Fatalf("Invalid routing rule model %q: must contain a provider prefix", rule.Model)
 		}
-
-		// Return a properly formatted error response
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": map[string]interface{}{
-				"message": openRouterErr.Error.Message,
-				"type":    openRouterErr.Error.Type,
-				"code":    openRouterErr.Error.Code,
-			},
-		})
-		return
+		rules = append(rules, routingRule{pattern: pattern, model: model})
 	}
+	return rules
+}
 
-	// Handle streaming response
-	if chatReq.Stream {
-		handleStreamingResponse(w, r, resp)
-		return
+// routeByContent returns the model of the first routing rule matching the
+// message contents, or an empty string
+func routeByContent(messages []Message) string {
+	if len(routingRules) == 0 {
+		return ""
+	}
+	var text strings.Builder
+	for _, message := range messages {
+		text.WriteString(message.Content.String())
+		text.WriteString("\n")
 	}
+	content := text.String()
+	for _, rule := range routingRules {
+		if rule.pattern.MatchString(content) {
+			return rule.model
+		}
+	}
+	return ""
+}
 
-	// Handle regular response
-	handleRegularResponse(w, resp)
+// providerState tracks the recent upstream outcomes of one provider
+type providerState struct {
+	mu        sync.Mutex
+	results   []providerResult
+	errorRate float64
+	unhealthy bool
+	lastError time.Time
 }
 
-func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response) {
-	debugLog("Starting streaming response handling")
-	debugLog("Response status: %d", resp.StatusCode)
-	debugLog("Response headers: %+v", resp.Header)
+type providerResult struct {
+	at     time.Time
+	failed bool
+}
 
-	// Set headers for streaming response
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.WriteHeader(resp.StatusCode)
+// providerWindow is the rolling window of the provider error rate, and
+// providerMinRequests the number of requests needed before an outage is declared
+const (
+	providerWindow      = time.Minute
+	providerMinRequests = 5
+)
 
-	// Create a buffered reader for the response body
-	reader := bufio.NewReader(resp.Body)
+var (
+	providerHealthMu sync.Mutex
+	providerHealth   = make(map[string]*providerState)
+)
 
-	// Create a context with cancel for cleanup
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
+// extractProvider returns the provider of a model ID, the part before the
+// first slash ("openai" for "openai/gpt-4o"), or "unknown" without one
+func extractProvider(model string) string {
+	if i := strings.Index(model, "/"); i > 0 {
+		return model[:i]
+	}
+	return "unknown"
+}
+
+func providerStateFor(provider string) *providerState {
+	providerHealthMu.Lock()
+	defer providerHealthMu.Unlock()
+	state, ok := providerHealth[provider]
+	if !ok {
+		state = &providerState{}
+		providerHealth[provider] = state
+	}
+	return state
+}
+
+// recordProviderResult counts transport errors and 5xx responses as
+// provider failures. Client cancellations are ignored.
+func recordProviderResult(model string, resp *http.Response, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	state := providerStateFor(extractProvider(model))
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.results = append(state.results, providerResult{at: time.Now(), failed: failed})
+	if failed {
+		state.lastError = time.Now()
+	}
+}
+
+// evaluate drops results older than providerWindow and updates the health
+// of the provider. It reports whether the health changed, and the error rate.
+func (p *providerState) evaluate(threshold float64) (bool, float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cutoff := time.Now().Add(-providerWindow)
+	kept := p.results[:0]
+	failures := 0
+	for _, result := range p.results {
+		if result.at.After(cutoff) {
+			kept = append(kept, result)
+			if result.failed {
+				failures++
+			}
+		}
+	}
+	p.results = kept
+
+	p.errorRate = 0
+	if len(kept) > 0 {
+		p.errorRate = float64(failures) / float64(len(kept))
+	}
+	unhealthy := len(kept) >= providerMinRequests && p.errorRate >= threshold
+	changed := unhealthy != p.unhealthy
+	p.unhealthy = unhealthy
+	return changed, p.errorRate
+}
 
-	// Start a goroutine to send heartbeats
+// watchProviderHealth re-evaluates every provider on a fixed interval
+func watchProviderHealth() {
+	threshold := envFloat("PROVIDER_OUTAGE_THRESHOLD", 0.8)
+	interval := time.Duration(envInt("PROVIDER_HEALTH_INTERVAL", 10)) * time.Second
 	go func() {
-		ticker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		for {
-			select {
-			case <-ticker.C:
-				// Send a heartbeat comment
-				if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
-					log.Printf("Error sending heartbeat: %v", err)
-					cancel()
-					return
-				}
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
+		for range time.Tick(interval) {
+			providerHealthMu.Lock()
+			states := make(map[string]*providerState, len(providerHealth))
+			for provider, state := range providerHealth {
+				states[provider] = state
+			}
+			providerHealthMu.Unlock()
+
+			for provider, state := range states {
+				if changed, rate := state.evaluate(threshold); changed {
+					if providerHealthy(provider) {
+						log.Printf("Provider %s recovered (error rate %.2f)", provider, rate)
+					} else {
+						log.Printf("Warning: provider %s marked unhealthy (error rate %.2f)", provider, rate)
+					}
 				}
-			case <-ctx.Done():
-				return
 			}
 		}
 	}()
+}
+
+// providerHealthy reports whether provider is not in an outage
+func providerHealthy(provider string) bool {
+	providerHealthMu.Lock()
+	state, ok := providerHealth[provider]
+	providerHealthMu.Unlock()
+	if !ok {
+		return true
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return !state.unhealthy
+}
+
+// firstHealthyFallback returns the first of models whose provider is
+// healthy, or an empty string
+func firstHealthyFallback(models []string) string {
+	for _, model := range models {
+		if providerHealthy(extractProvider(model)) {
+			return model
+		}
+	}
+	return ""
+}
+
+// providerHealthReport summarizes provider health for /health
+func providerHealthReport() map[string]interface{} {
+	providerHealthMu.Lock()
+	defer providerHealthMu.Unlock()
+	report := make(map[string]interface{}, len(providerHealth))
+	for provider, state := range providerHealth {
+		state.mu.Lock()
+		report[provider] = map[string]interface{}{
+			"healthy":    !state.unhealthy,
+			"error_rate": state.errorRate,
+		}
+		state.mu.Unlock()
+	}
+	return report
+}
+
+// ProviderStatus is the health of one provider reported by /v1/providers
+type ProviderStatus struct {
+	// healthy without recent failures, degraded with some, unhealthy once
+	// PROVIDER_OUTAGE_THRESHOLD is reached
+	Status      string  `json:"status"`
+	ErrorRate   float64 `json:"error_rate"`
+	LastErrorAt string  `json:"last_error_at,omitempty"`
+
+	// Average probed time to first token of its models, with
+	// LATENCY_ROUTING_MODELS
+	LatencyEWMAMs map[string]float64 `json:"latency_ewma_ms,omitempty"`
+}
+
+// providerStatuses reports the health of every provider that served a
+// request, and of the providers of the configured models
+func providerStatuses() map[string]ProviderStatus {
+	statuses := make(map[string]ProviderStatus)
+	state := activeState.Load()
+	models := append([]string{state.config.model}, state.fallbackModels...)
+	if latencyRouter != nil {
+		models = append(models, latencyRouter.models...)
+	}
+	for _, model := range models {
+		statuses[extractProvider(model)] = ProviderStatus{Status: "healthy"}
+	}
+
+	providerHealthMu.Lock()
+	for provider, state := range providerHealth {
+		state.mu.Lock()
+		status := ProviderStatus{Status: "healthy", ErrorRate: state.errorRate}
+		if state.unhealthy {
+			status.Status = "unhealthy"
+		} else if state.errorRate > 0 {
+			status.Status = "degraded"
+		}
+		if !state.lastError.IsZero() {
+			status.LastErrorAt = state.lastError.UTC().Format(time.RFC3339)
+		}
+		state.mu.Unlock()
+		statuses[provider] = status
+	}
+	providerHealthMu.Unlock()
+
+	if latencyRouter != nil {
+		for _, model := range latencyRouter.models {
+			latency, ok := latencyRouter.latency(model)
+			if !ok {
+				continue
+			}
+			status := statuses[extractProvider(model)]
+			if status.LatencyEWMAMs == nil {
+				status.LatencyEWMAMs = make(map[string]float64)
+			}
+			status.LatencyEWMAMs[model] = math.Round(latency*10) / 10
+			statuses[extractProvider(model)] = status
+		}
+	}
+	return statuses
+}
+
+var errQueueFull = errors.New("request queue full")
+
+// semaphore bounds the requests handled at once (MAX_CONCURRENT_REQUESTS)
+var semaphore chan struct{}
+
+// Upstream retry settings
+var (
+	upstreamMaxRetries int
+	retryAfterCap      time.Duration
+	retryStrategy      RetryStrategy
+)
+
+// queuedJob is a unit of work run by a queue worker
+type queuedJob struct {
+	ctx     context.Context
+	work    func()
+	skipped bool
+	done    chan struct{}
+}
+
+// priorityQueue is a bounded queue served by a fixed pool of workers, high
+// priority jobs first
+type priorityQueue struct {
+	slots  chan struct{}
+	high   chan *queuedJob
+	normal chan *queuedJob
+	low    chan *queuedJob
+}
+
+var requestQueue *priorityQueue
+
+// newPriorityQueue creates a queue holding up to depth jobs and starts its
+// workers
+func newPriorityQueue(depth, workers int) *priorityQueue {
+	q := &priorityQueue{
+		slots:  make(chan struct{}, depth),
+		high:   make(chan *queuedJob, depth),
+		normal: make(chan *queuedJob, depth),
+		low:    make(chan *queuedJob, depth),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// submit queues work and waits until it has run. Jobs whose context is done
+// by the time a worker picks them up are skipped and report the context error.
+func (q *priorityQueue) submit(ctx context.Context, priority string, work func()) error {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		return errQueueFull
+	}
+
+	job := &queuedJob{ctx: ctx, work: work, done: make(chan struct{})}
+	switch priority {
+	case "high":
+		q.high <- job
+	case "low":
+		q.low <- job
+	default:
+		q.normal <- job
+	}
+	<-job.done
+	if job.skipped {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// next returns the highest priority job, waiting if none is queued
+func (q *priorityQueue) next() *queuedJob {
+	select {
+	case job := <-q.high:
+		return job
+	default:
+	}
+	select {
+	case job := <-q.high:
+		return job
+	case job := <-q.normal:
+		return job
+	default:
+	}
+	select {
+	case job := <-q.high:
+		return job
+	case job := <-q.normal:
+		return job
+	case job := <-q.low:
+		return job
+	}
+}
 
+func (q *priorityQueue) worker() {
 	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("Context cancelled, ending stream")
-			return
-		default:
-			line, err := reader.ReadBytes('\n')
-			if err != nil {
-				if err == io.EOF {
-					continue
-				}
-				log.Printf("Error reading stream: %v", err)
-				cancel()
+		job := q.next()
+		<-q.slots
+		if job.ctx.Err() != nil {
+			job.skipped = true
+		} else {
+			job.work()
+		}
+		close(job.done)
+	}
+}
+
+// asyncJob holds the state and, once done is closed, the response of an
+// async request
+type asyncJob struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (j *asyncJob) Header() http.Header {
+	return j.header
+}
+
+func (j *asyncJob) Write(b []byte) (int, error) {
+	if j.status == 0 {
+		j.status = http.StatusOK
+	}
+	return j.body.Write(b)
+}
+
+func (j *asyncJob) WriteHeader(status int) {
+	if j.status == 0 {
+		j.status = status
+	}
+}
+
+var asyncJobs sync.Map
+
+// asyncJobKey marks the context of a request replayed by startAsyncJob
+type asyncJobKey struct{}
+
+func asyncJobFrom(ctx context.Context) bool {
+	job, _ := ctx.Value(asyncJobKey{}).(bool)
+	return job
+}
+
+// startAsyncJob replays r through proxyHandler in the background, detached
+// from the client connection, and returns the job ID. The job keeps the
+// concurrency slot of r and calls releaseSlot once done.
+func startAsyncJob(r *http.Request, body []byte, releaseSlot func()) string {
+	jobID := uuid.NewString()
+	job := &asyncJob{done: make(chan struct{}), header: make(http.Header)}
+	asyncJobs.Store(jobID, job)
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, requestIDFrom(r.Context()))
+	ctx = context.WithValue(ctx, requestSummaryKey{}, &requestSummary{start: time.Now()})
+	ctx = context.WithValue(ctx, asyncJobKey{}, true)
+	if tenant := sniTenantFrom(r.Context()); tenant != nil {
+		ctx = context.WithValue(ctx, sniTenantKey{}, tenant)
+	}
+	jobReq := r.Clone(ctx)
+	jobReq.Header.Del("X-Async")
+	jobReq.Body = io.NopCloser(bytes.NewReader(body))
+
+	go func() {
+		defer func() {
+			// The job runs outside RecoveryMiddleware, so a panic would
+			// take the process down and leave the job pending forever
+			if err := recover(); err != nil {
+				reqLog(ctx, "Panic in async job %s: %v\n%s", jobID, err, debug.Stack())
+				job.status = 0
+				job.header = make(http.Header)
+				job.body.Reset()
+				writeError(job, http.StatusInternalServerError, errTypeServer, "Internal server error")
+			}
+			if releaseSlot != nil {
+				releaseSlot()
+			}
+			close(job.done)
+
+			time.AfterFunc(time.Duration(envInt("JOB_TTL_SECONDS", 300))*time.Second, func() {
+				asyncJobs.Delete(jobID)
+			})
+		}()
+		proxyHandler(job, jobReq)
+	}()
+	return jobID
+}
+
+func handleGetJobRequest(w http.ResponseWriter, jobID string) {
+	value, ok := asyncJobs.Load(jobID)
+	if !ok {
+		writeError(w, http.StatusNotFound, errTypeInvalidRequest, "Job not found or expired")
+		return
+	}
+	job := value.(*asyncJob)
+
+	select {
+	case <-job.done:
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "pending"})
+		return
+	}
+
+	w.Header().Set("Content-Type", job.header.Get("Content-Type"))
+	w.WriteHeader(job.status)
+	w.Write(job.body.Bytes())
+}
+
+// batchRequest is the body of POST /v1/chat/completions/batch
+type batchRequest struct {
+	Requests []json.RawMessage `json:"requests"`
+}
+
+// handleBatchRequest runs each request of a batch through proxyHandler, at
+// most batchConcurrency at a time, and returns the responses in request
+// order. A failed request yields its error body in place of a response.
+func handleBatchRequest(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Invalid JSON")
+		return
+	}
+	if len(req.Requests) == 0 {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "requests must contain at least one request")
+		return
+	}
+
+	// The timeout covers the whole batch, queued requests included
+	ctx, cancel := context.WithTimeout(r.Context(), batchTimeout)
+	defer cancel()
+
+	responses := make([]json.RawMessage, len(req.Requests))
+	slots := make(chan struct{}, batchConcurrency)
+	var wg sync.WaitGroup
+	for i, body := range req.Requests {
+		var chatReq ChatRequest
+		if err := json.Unmarshal(body, &chatReq); err != nil {
+			responses[i] = errorBody(http.StatusBadRequest, errTypeInvalidRequest, "Invalid JSON")
+			continue
+		}
+		if chatReq.Stream {
+			responses[i] = errorBody(http.StatusBadRequest, errTypeInvalidRequest, "Streaming is not supported in batch requests")
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, body []byte) {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				responses[i] = errorBody(http.StatusGatewayTimeout, errTypeServer, "Batch timeout exceeded")
 				return
 			}
+			responses[i] = runBatchItem(ctx, r, i, body)
+		}(i, body)
+	}
+	wg.Wait()
+
+	reqLog(r.Context(), "Completed batch of %d requests", len(req.Requests))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+}
+
+// runBatchItem sends one batch entry through proxyHandler as a regular
+// /v1/chat/completions request with the headers of the batch request
+func runBatchItem(ctx context.Context, r *http.Request, index int, body []byte) json.RawMessage {
+	ctx = context.WithValue(ctx, requestIDKey{}, fmt.Sprintf("%s-%d", requestIDFrom(r.Context()), index))
+	ctx = context.WithValue(ctx, requestSummaryKey{}, &requestSummary{start: time.Now()})
+	itemReq := r.Clone(ctx)
+	itemReq.URL.Path = "/v1/chat/completions"
+	itemReq.Header.Del("X-Async")
+	itemReq.Body = io.NopCloser(bytes.NewReader(body))
+	itemReq.ContentLength = int64(len(body))
+
+	// asyncJob serves as an in-memory response writer, and each entry
+	// counts against the rate limit of the key
+	result := &asyncJob{header: make(http.Header)}
+	Chain(http.HandlerFunc(proxyHandler), RateLimitMiddleware()).ServeHTTP(result, itemReq)
+
+	response := result.body.Bytes()
+	if !json.Valid(response) {
+		if ctx.Err() != nil {
+			return errorBody(http.StatusGatewayTimeout, errTypeServer, "Batch timeout exceeded")
+		}
+		return errorBody(http.StatusBadGateway, errTypeServer, fmt.Sprintf("Invalid response (status %d)", result.status))
+	}
+	return response
+}
+
+// weightedSelector picks a model per request according to configured weights
+type weightedSelector struct {
+	models []string
+	cdf    []float64
+}
+
+// newWeightedSelector parses a "model:weight,model:weight" list
+func newWeightedSelector(value string) (*weightedSelector, error) {
+	selector := &weightedSelector{}
+	total := 0.0
+	for _, item := range splitList(value) {
+		sep := strings.LastIndex(item, ":")
+		if sep <= 0 {
+			return nil, fmt.Errorf("entry %q must be model:weight", item)
+		}
+		model := resolveAlias(strings.TrimSpace(item[:sep]), modelAliases)
+		weight, err := strconv.ParseFloat(strings.TrimSpace(item[sep+1:]), 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("entry %q has an invalid weight", item)
+		}
+		if !strings.Contains(model, "/") {
+			return nil, fmt.Errorf("model %s must contain a provider prefix", model)
+		}
+		total += weight
+		selector.models = append(selector.models, model)
+		selector.cdf = append(selector.cdf, total)
+	}
+	if len(selector.models) == 0 {
+		return nil, errors.New("no models configured")
+	}
+	for i := range selector.cdf {
+		selector.cdf[i] /= total
+	}
+	return selector, nil
+}
+
+// Select returns a model drawn according to the configured weights
+func (s *weightedSelector) Select() string {
+	n := rand.Float64()
+	for i, bound := range s.cdf {
+		if n < bound {
+			return s.models[i]
+		}
+	}
+	return s.models[len(s.models)-1]
+}
+
+// constraintsFor returns the constraints of the longest provider prefix
+// matching model, or no constraints if none match
+func constraintsFor(model string) ModelConstraints {
+	var constraints ModelConstraints
+	matched := ""
+	model = normalizeModelID(model)
+	for prefix, c := range providerConstraints {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(matched) {
+			constraints, matched = c, prefix
+		}
+	}
+	return constraints
+}
+
+// clampFloat caps value at max, a zero max meaning no limit
+func clampFloat(value, max float64) float64 {
+	if max > 0 && value > max {
+		return max
+	}
+	return value
+}
+
+// loadDotEnv loads DOTENV_FILE if set, otherwise .env.local then .env.
+// godotenv never overrides variables that are already set, so the process
+// environment wins over .env.local, which wins over .env.
+func loadDotEnv() {
+	files := []string{".env.local", ".env"}
+	if path := os.Getenv("DOTENV_FILE"); path != "" {
+		files = []string{path}
+	}
+
+	loaded := 0
+	for _, file := range files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if err := godotenv.Load(file); err != nil {
+			log.Printf("Warning: error loading %s: %v", file, err)
+			continue
+		}
+		log.Printf("Loaded environment from %s", file)
+		loaded++
+	}
+
+	if loaded == 0 {
+		log.Printf("Warning: no .env file found, using process environment only")
+	}
+}
+
+// parseKeyValues parses "key=value;key2=value2" env values
+func parseKeyValues(value string) map[string]string {
+	pairs := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(entry, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !ok || key == "" || val == "" {
+			if strings.TrimSpace(entry) != "" {
+				log.Printf("Warning: ignoring malformed entry %q", entry)
+			}
+			continue
+		}
+		pairs[key] = val
+	}
+	return pairs
+}
+
+// normalizeModelID canonicalizes a model ID so GPT-4O and gpt-4o are the
+// same model
+func normalizeModelID(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// resolveAlias returns the normalized model ID an alias points to, or the
+// normalized name when it is not an alias. Alias keys must be normalized.
+func resolveAlias(name string, aliases map[string]string) string {
+	name = normalizeModelID(name)
+	if model, ok := aliases[name]; ok {
+		debugLog("Resolved model alias %s to %s", name, model)
+		return normalizeModelID(model)
+	}
+	return name
+}
+
+// isMockedModel reports whether model is one of the names Cursor uses for
+// the configured model
+func isMockedModel(model string) bool {
+	model = strings.TrimSpace(model)
+	for _, mocked := range cursorMockedModels {
+		if strings.EqualFold(model, mocked) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBudget is the cumulative token allowance of one API key
+type tokenBudget struct {
+	limit int64
+	used  int64
+}
+
+// tokenBudgets maps the hash of an API key to its budget, from
+// BUDGET_<SHA256_PREFIX_8>_TOKENS variables
+var tokenBudgets map[string]*tokenBudget
+
+var budgetEnvPattern = regexp.MustCompile(`^BUDGET_([0-9a-fA-F]{8})_TOKENS$`)
+
+// hashKey returns the first 8 hex characters of the SHA-256 of key
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// loadTokenBudgets reads the budgets from the environment
+func loadTokenBudgets() map[string]*tokenBudget {
+	budgets := make(map[string]*tokenBudget)
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		match := budgetEnvPattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || limit <= 0 {
+			log.Fatalf("Invalid %s: %q", name, value)
+		}
+		budgets[strings.ToLower(match[1])] = &tokenBudget{limit: limit}
+	}
+	return budgets
+}
+
+func budgetExceeded(keyHash string) bool {
+	budget, ok := tokenBudgets[keyHash]
+	return ok && atomic.LoadInt64(&budget.used) >= budget.limit
+}
+
+// chargeBudget adds the tokens used by a completed request to the budget of
+// its key, and their price to the spend
+func chargeBudget(keyHash string, summary *requestSummary) {
+	if budget, ok := tokenBudgets[keyHash]; ok {
+		atomic.AddInt64(&budget.used, int64(summary.promptTokens+summary.completionTokens))
+	}
+	chargeCost(summary)
+}
+
+// modelPrice is the USD price of a million prompt and completion tokens
+type modelPrice struct {
+	prompt     float64
+	completion float64
+}
+
+var (
+	// Prices by model from MODEL_PRICES, e.g. "openai/gpt-4o=2.5,10"
+	modelPrices map[string]modelPrice
+
+	// Spend allowed per budget period (COST_BUDGET_USD), and the percentage
+	// of it at which the budget alert fires (COST_ALERT_THRESHOLD_PERCENT)
+	costBudgetUSD             float64
+	costAlertThresholdPercent float64
+	alertWebhookURL           string
+
+	// Spend of the current budget period in millionths of a dollar, and
+	// whether its alert already fired
+	costSpentMicroUSD int64
+	costAlertSent     atomic.Bool
+)
+
+// parseModelPrice parses a "prompt,completion" MODEL_PRICES value
+func parseModelPrice(value string) (modelPrice, bool) {
+	promptText, completionText, ok := strings.Cut(value, ",")
+	if !ok {
+		return modelPrice{}, false
+	}
+	prompt, err := strconv.ParseFloat(strings.TrimSpace(promptText), 64)
+	if err != nil || prompt < 0 {
+		return modelPrice{}, false
+	}
+	completion, err := strconv.ParseFloat(strings.TrimSpace(completionText), 64)
+	if err != nil || completion < 0 {
+		return modelPrice{}, false
+	}
+	return modelPrice{prompt: prompt, completion: completion}, true
+}
+
+// chargeCost adds the price of the tokens of a completed request to the
+// spend, and fires the budget alert once the spend crosses its threshold
+func chargeCost(summary *requestSummary) {
+	price, ok := modelPrices[normalizeModelID(summary.model)]
+	if !ok {
+		return
+	}
+	// A price per million tokens times a token count is in millionths of a
+	// dollar
+	cost := float64(summary.promptTokens)*price.prompt + float64(summary.completionTokens)*price.completion
+	spent := float64(atomic.AddInt64(&costSpentMicroUSD, int64(math.Round(cost)))) / 1e6
+	if costBudgetUSD <= 0 {
+		return
+	}
+	percentUsed := spent / costBudgetUSD * 100
+	if percentUsed >= costAlertThresholdPercent && costAlertSent.CompareAndSwap(false, true) {
+		log.Printf("Warning: spend of $%.2f is %.1f%% of the $%.2f budget", spent, percentUsed, costBudgetUSD)
+		if alertWebhookURL != "" {
+			go sendBudgetAlert(budgetAlert{
+				Alert:       "budget_threshold",
+				PercentUsed: percentUsed,
+				SpentUSD:    spent,
+				BudgetUSD:   costBudgetUSD,
+				Timestamp:   time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+	}
+}
+
+// budgetAlert is posted to ALERT_WEBHOOK_URL when the spend crosses
+// COST_ALERT_THRESHOLD_PERCENT of the budget
+type budgetAlert struct {
+	Alert       string  `json:"alert"`
+	PercentUsed float64 `json:"percent_used"`
+	SpentUSD    float64 `json:"spent_usd"`
+	BudgetUSD   float64 `json:"budget_usd"`
+	Timestamp   string  `json:"timestamp"`
+}
+
+func sendBudgetAlert(alert budgetAlert) {
+	payload, _ := json.Marshal(alert)
+	resp, err := webhookClient.Post(alertWebhookURL, "application/json", bytes.NewReader(payload))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: budget alert webhook call failed: %v", err)
+	}
+}
+
+// resetBudgetsDaily clears the budget counters and the spend every day at
+// midnight UTC
+func resetBudgetsDaily() {
+	go func() {
+		for {
+			now := time.Now().UTC()
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			time.Sleep(midnight.Sub(now))
+			for _, budget := range tokenBudgets {
+				atomic.StoreInt64(&budget.used, 0)
+			}
+			atomic.StoreInt64(&costSpentMicroUSD, 0)
+			costAlertSent.Store(false)
+			log.Printf("Token budgets reset")
+		}
+	}()
+}
+
+func handleGetBudgetRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	report := make(map[string]map[string]int64, len(tokenBudgets))
+	for keyHash, budget := range tokenBudgets {
+		report[keyHash] = map[string]int64{
+			"limit": budget.limit,
+			"used":  atomic.LoadInt64(&budget.used),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// conversationSession is the stored history of one X-Session-ID
+type conversationSession struct {
+	messages []Message
+	expires  time.Time
+}
+
+// sessionStore keeps conversation history in memory for clients that only
+// send their latest message (SESSION_STORE)
+type sessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*conversationSession
+	ttl       time.Duration
+	maxTokens int
+}
+
+var sessions *sessionStore
+
+func newSessionStore(ttl time.Duration, maxTokens int) *sessionStore {
+	store := &sessionStore{sessions: make(map[string]*conversationSession), ttl: ttl, maxTokens: maxTokens}
+	go func() {
+		for range time.Tick(time.Minute) {
+			store.expire()
+		}
+	}()
+	return store
+}
+
+// history returns a copy of the messages of a live session
+func (s *sessionStore) history(id string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.expires) {
+		return nil
+	}
+	return append([]Message(nil), session.messages...)
+}
+
+// append adds a completed turn to a session, dropping the oldest turns once
+// the history exceeds maxTokens. A turn runs from a user message to the next
+// one, so tool results are dropped with the tool call they answer; system
+// messages are always kept.
+func (s *sessionStore) append(id string, turn []Message, reply Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.expires) {
+		session = &conversationSession{}
+		s.sessions[id] = session
+	}
+	session.messages = append(session.messages, turn...)
+	session.messages = append(session.messages, reply)
+	session.expires = time.Now().Add(s.ttl)
+
+	var system, turns []Message
+	tokens := 0
+	for _, message := range session.messages {
+		if message.Role == "system" {
+			system = append(system, message)
+		} else {
+			turns = append(turns, message)
+		}
+		tokens += estimateTokens(message.Content.String())
+	}
+	for len(turns) > 0 && tokens > s.maxTokens {
+		end := 1
+		for end < len(turns) && turns[end].Role != "user" {
+			end++
+		}
+		for _, message := range turns[:end] {
+			tokens -= estimateTokens(message.Content.String())
+		}
+		turns = turns[end:]
+	}
+	session.messages = append(system, turns...)
+}
+
+// expire drops the sessions past their TTL
+func (s *sessionStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// estimateTokens counts the tokens of text with cl100k_base, falling back
+// to four characters per token when the encoding is unavailable
+func estimateTokens(text string) int {
+	if encoding := streamTokenizer(); encoding != nil {
+		return len(encoding.Encode(text, nil, nil))
+	}
+	return (len(text) + 3) / 4
+}
+
+// limiterFor returns the rate limiter of an API key: its own, created on
+// first use, for the keys of KEY_RATE_LIMITS, and the shared RATE_LIMIT_RPS
+// one, or nil when it is disabled, for any other key
+func limiterFor(key string) *rate.Limiter {
+	rpm, ok := keyRateLimits[key]
+	if !ok {
+		return sharedLimiter
+	}
+	if limiter, ok := rateLimiters.Load(key); ok {
+		return limiter.(*rate.Limiter)
+	}
+	actual, _ := rateLimiters.LoadOrStore(key, rate.NewLimiter(rate.Limit(float64(rpm)/60), rpm))
+	return actual.(*rate.Limiter)
+}
+
+// envFloat reads a float env var, falling back to def when unset or invalid
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		log.Printf("Warning: invalid %s value %q, using default %v", name, value, def)
+		return def
+	}
+	return f
+}
+
+// envDuration parses a duration (e.g. "90s") from the environment
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d < 0 {
+		log.Printf("Warning: invalid %s value %q, using default %s", name, value, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads an integer env var, falling back to def when unset or invalid
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("Warning: invalid %s value %q, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// providerIn reports whether the provider prefix of model is one of providers.
+// Entries may be given with or without the trailing slash (e.g. "mistralai").
+func providerIn(model string, providers []string) bool {
+	for _, provider := range providers {
+		if extractProvider(model) == strings.TrimSuffix(provider, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+func debugLog(format string, args ...interface{}) {
+	if debugMode {
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+type requestIDKey struct{}
+
+type requestSummaryKey struct{}
+
+// requestSummary collects the fields of the summary line logged once per
+// request by loggingMiddleware
+type requestSummary struct {
+	start         time.Time
+	parseDone     time.Time
+	upstreamStart time.Time
+	upstreamWait  time.Duration
+	ttft          time.Duration
+	model         string
+	stream        bool
+	requestBytes  int
+
+	modelRequested   string
+	promptTokens     int
+	completionTokens int
+
+	// Text of the first choice of a successful response
+	completion string
+
+	// OpenRouter generation ID, for looking the request up on OpenRouter
+	generationID string
+
+	// Config change recorded in the audit log, e.g. config_import
+	action string
+
+	// Number of messages and hash of the last user message, for the slow
+	// request log
+	messageCount    int
+	lastUserMessage string
+}
+
+// parsed records the end of request parsing
+func (s *requestSummary) parsed(requestBytes int, stream bool) {
+	s.parseDone = time.Now()
+	s.requestBytes = requestBytes
+	s.stream = stream
+}
+
+// firstByte records the upstream wait time, only the first call counts.
+// It reports whether this call recorded it.
+func (s *requestSummary) firstByte() bool {
+	if s.upstreamWait == 0 && !s.upstreamStart.IsZero() {
+		s.upstreamWait = time.Since(s.upstreamStart)
+		return true
+	}
+	return false
+}
+
+// recordUsage records token counts from an upstream usage object
+func (s *requestSummary) recordUsage(promptTokens, completionTokens int) {
+	s.promptTokens = promptTokens
+	s.completionTokens = completionTokens
+}
+
+// summaryFrom returns the summary stored in ctx. A detached summary is
+// returned outside of loggingMiddleware so callers never need a nil check.
+func summaryFrom(ctx context.Context) *requestSummary {
+	if summary, ok := ctx.Value(requestSummaryKey{}).(*requestSummary); ok {
+		return summary
+	}
+	return &requestSummary{start: time.Now()}
+}
+
+// statusRecorder captures the status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming working through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Push keeps HTTP/2 server push available through the recorder
+func (s *statusRecorder) Push(target string, opts *http.PushOptions) error {
+	if p, ok := s.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// loggingMiddleware logs a single machine-parseable summary line once each
+// request completes, streaming included
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		summary := &requestSummary{start: time.Now()}
+		recorder := &statusRecorder{ResponseWriter: w}
+		requestsTotal.Add(1)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		ctx = context.WithValue(ctx, requestSummaryKey{}, summary)
+
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.status_code", status), attribute.String("model", summary.model))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		parseMs := int64(0)
+		if !summary.parseDone.IsZero() {
+			parseMs = summary.parseDone.Sub(summary.start).Milliseconds()
+		}
+		line, _ := json.Marshal(map[string]interface{}{
+			"request_id":       requestIDFrom(r.Context()),
+			"method":           r.Method,
+			"path":             r.URL.Path,
+			"model":            summary.model,
+			"stream":           summary.stream,
+			"parse_ms":         parseMs,
+			"upstream_wait_ms": summary.upstreamWait.Milliseconds(),
+			"ttft_ms":          summary.ttft.Milliseconds(),
+			"total_ms":         time.Since(summary.start).Milliseconds(),
+			"request_bytes":    summary.requestBytes,
+			"response_bytes":   recorder.bytes,
+			"status":           status,
+			"generation_id":    summary.generationID,
+		})
+		log.Printf("request_summary %s", line)
+
+		if total := time.Since(summary.start); slowRequestThreshold > 0 && summary.model != "" && total > slowRequestThreshold {
+			logSlowRequest(requestIDFrom(r.Context()), summary, total)
+		}
+
+		if summary.model != "" {
+			stats.record(summary, status)
+			if summary.upstreamWait > 0 {
+				recordLatency(summary.model, summary.upstreamWait)
+			}
+		}
+		recordOTelRequest(ctx, summary, status, float64(time.Since(summary.start))/float64(time.Millisecond))
+
+		if webhookURL != "" && summary.model != "" && !summary.stream && status < 400 {
+			go sendWebhook(webhookEvent{
+				RequestID:        requestIDFrom(r.Context()),
+				Model:            summary.model,
+				Timestamp:        summary.start.UTC().Format(time.RFC3339Nano),
+				DurationMs:       time.Since(summary.start).Milliseconds(),
+				PromptTokens:     summary.promptTokens,
+				CompletionTokens: summary.completionTokens,
+				StatusCode:       status,
+			})
+		}
+
+		if auditLog != nil {
+			auditLog.write(auditRecord{
+				Timestamp:        summary.start.UTC().Format(time.RFC3339Nano),
+				RequestID:        requestIDFrom(r.Context()),
+				RemoteAddr:       auditRemoteAddr(r.RemoteAddr),
+				ModelRequested:   summary.modelRequested,
+				ModelUsed:        summary.model,
+				Stream:           summary.stream,
+				PromptTokens:     summary.promptTokens,
+				CompletionTokens: summary.completionTokens,
+				StatusCode:       status,
+				Action:           summary.action,
+			})
+		}
+	})
+}
+
+// ModelStats holds the usage counters of one model
+type ModelStats struct {
+	RequestCount     int64 `json:"request_count"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	ErrorCount       int64 `json:"error_count"`
+	TotalDurationMs  int64 `json:"total_duration_ms"`
+
+	// Average probed time to first token, with LATENCY_ROUTING_MODELS
+	LatencyEWMAMs float64 `json:"latency_ewma_ms,omitempty"`
+}
+
+// statsStore accumulates per-model usage statistics in memory
+type statsStore struct {
+	mu     sync.RWMutex
+	models map[string]*ModelStats
+}
+
+var stats = &statsStore{models: make(map[string]*ModelStats)}
+
+// record adds a completed request to the stats of its model
+func (s *statsStore) record(summary *requestSummary, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.models[summary.model]
+	if !ok {
+		entry = &ModelStats{}
+		s.models[summary.model] = entry
+	}
+	entry.RequestCount++
+	entry.PromptTokens += int64(summary.promptTokens)
+	entry.CompletionTokens += int64(summary.completionTokens)
+	entry.TotalDurationMs += time.Since(summary.start).Milliseconds()
+	if status >= 400 {
+		entry.ErrorCount++
+	}
+}
+
+// snapshot returns a copy of the stats, limited to model when it is not empty
+func (s *statsStore) snapshot(model string) map[string]ModelStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	result := make(map[string]ModelStats)
+	for id, entry := range s.models {
+		if model == "" || id == model {
+			result[id] = *entry
+		}
+	}
+	if latencyRouter != nil {
+		for _, id := range latencyRouter.models {
+			latency, ok := latencyRouter.latency(id)
+			if ok && (model == "" || id == model) {
+				entry := result[id]
+				entry.LatencyEWMAMs = math.Round(latency*10) / 10
+				result[id] = entry
+			}
+		}
+	}
+	return result
+}
+
+func (s *statsStore) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.models = make(map[string]*ModelStats)
+}
+
+// latencyWindow keeps the last LATENCY_WINDOW_SIZE upstream latencies of a
+// model, in milliseconds, in a circular buffer
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []float64
+	next    int
+}
+
+// add records a sample, replacing the oldest once the window is full
+func (l *latencyWindow) add(ms float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < latencyWindowSize {
+		l.samples = append(l.samples, ms)
+		return
+	}
+	l.samples[l.next] = ms
+	l.next = (l.next + 1) % len(l.samples)
+}
+
+// LatencyStats summarizes the samples of a latency window
+type LatencyStats struct {
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// stats computes the percentiles of the window with the nearest-rank method
+func (l *latencyWindow) stats() LatencyStats {
+	l.mu.Lock()
+	sorted := append([]float64(nil), l.samples...)
+	l.mu.Unlock()
+	if len(sorted) == 0 {
+		return LatencyStats{}
+	}
+	sort.Float64s(sorted)
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return LatencyStats{
+		Count: len(sorted),
+		Min:   sorted[0],
+		Max:   sorted[len(sorted)-1],
+		P50:   rank(50),
+		P95:   rank(95),
+		P99:   rank(99),
+	}
+}
+
+// Upstream latency windows by model, served on GET /v1/latency
+var (
+	latencyWindowSize = 100
+
+	latencyWindowsMu sync.Mutex
+	latencyWindows   = make(map[string]*latencyWindow)
+)
+
+// recordLatency adds an upstream latency sample to the window of model
+func recordLatency(model string, latency time.Duration) {
+	latencyWindowsMu.Lock()
+	window, ok := latencyWindows[model]
+	if !ok {
+		window = &latencyWindow{}
+		latencyWindows[model] = window
+	}
+	latencyWindowsMu.Unlock()
+	window.add(float64(latency) / float64(time.Millisecond))
+}
+
+// watchReloadSignal handles SIGHUP reloads
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Printf("Received SIGHUP")
+			recordConfigChange("sighup", "sighup")
+			health.invalidate()
+			cachedModels.invalidate()
+			tenantConfigs.Range(func(key, _ interface{}) bool {
+				tenantConfigs.Delete(key)
+				return true
+			})
+			if os.Getenv("RESET_STATS_ON_RELOAD") == "true" {
+				stats.reset()
+				log.Printf("Usage statistics reset")
+			}
+		}
+	}()
+}
+
+// webhookEvent is posted to WEBHOOK_URL after each successful non-streaming
+// response, as JSON or through WEBHOOK_TEMPLATE
+type webhookEvent struct {
+	RequestID        string `json:"request_id"`
+	Model            string `json:"model"`
+	Timestamp        string `json:"timestamp"`
+	DurationMs       int64  `json:"duration_ms"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	StatusCode       int    `json:"status_code"`
+}
+
+var (
+	webhookURL      string
+	webhookTemplate *template.Template
+	webhookClient   = &http.Client{Timeout: 5 * time.Second}
+)
+
+// webhookRetries is the number of retries after a failed webhook call
+const webhookRetries = 2
+
+// sendWebhook posts event to WEBHOOK_URL, retrying failed calls
+func sendWebhook(event webhookEvent) {
+	var payload bytes.Buffer
+	if webhookTemplate != nil {
+		if err := webhookTemplate.Execute(&payload, event); err != nil {
+			log.Printf("Warning: rendering WEBHOOK_TEMPLATE failed: %v", err)
+			return
+		}
+	} else {
+		json.NewEncoder(&payload).Encode(event)
+	}
+
+	var err error
+	for attempt := 0; attempt <= webhookRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second)
+		}
+		var resp *http.Response
+		resp, err = webhookClient.Post(webhookURL, "application/json", bytes.NewReader(payload.Bytes()))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	log.Printf("Warning: webhook call for request %s failed: %v", event.RequestID, err)
+}
+
+// auditRecord is one line of the audit log
+type auditRecord struct {
+	Timestamp        string `json:"timestamp"`
+	RequestID        string `json:"request_id"`
+	RemoteAddr       string `json:"remote_addr"`
+	ModelRequested   string `json:"model_requested"`
+	ModelUsed        string `json:"model_used"`
+	Stream           bool   `json:"stream"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	StatusCode       int    `json:"status_code"`
+	Action           string `json:"action,omitempty"`
+}
+
+// slowLog receives the slow request entries when SLOW_LOG_FILE is set
+var slowLog io.Writer
+
+// logSlowRequest logs a request that took longer than
+// SLOW_REQUEST_THRESHOLD_MS, and appends it to SLOW_LOG_FILE. The prompt is
+// only identified by the hash of its last user message.
+func logSlowRequest(requestID string, summary *requestSummary, total time.Duration) {
+	tokens := summary.promptTokens + summary.completionTokens
+	if tokens == 0 {
+		tokens = (summary.requestBytes + 3) / 4
+	}
+	line, _ := json.Marshal(map[string]interface{}{
+		"request_id":             requestID,
+		"duration_ms":            total.Milliseconds(),
+		"model":                  summary.model,
+		"stream":                 summary.stream,
+		"estimated_tokens":       tokens,
+		"messages_count":         summary.messageCount,
+		"last_user_message_hash": summary.lastUserMessage,
+	})
+	log.Printf("Warning: slow_request %s", line)
+	if slowLog != nil {
+		if _, err := slowLog.Write(append(line, '\n')); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing slow request log: %v\n", err)
+		}
+	}
+}
+
+// auditLogger appends JSON lines to the audit log, kept apart from the
+// application log. lumberjack opens the file with O_APPEND|O_CREATE|O_WRONLY
+// and handles rotation.
+type auditLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+var auditLog *auditLogger
+
+func newAuditLogger(path string) *auditLogger {
+	return &auditLogger{out: &lumberjack.Logger{
+		Filename: path,
+		MaxSize:  envInt("AUDIT_LOG_MAX_SIZE_MB", 100),
+		MaxAge:   envInt("AUDIT_LOG_MAX_AGE_DAYS", 0),
+		Compress: true,
+	}}
+}
+
+// write appends record to the audit log. Failures are reported on stderr
+// and never fail the request.
+func (a *auditLogger) write(record auditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding audit record: %v\n", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.out.Write(line); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+	}
+}
+
+// Recording is one request/response pair written to RECORD_FILE and read
+// back by cmd/replay. Authorization headers are never recorded.
+type Recording struct {
+	Timestamp string `json:"timestamp"`
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Model     string `json:"model"`
+	Request   string `json:"request"`
+	Status    int    `json:"status"`
+	Response  string `json:"response"`
+}
+
+// recordFile appends recordings as JSON lines
+type recordFile struct {
+	mu  sync.Mutex
+	out *os.File
+}
+
+func (f *recordFile) write(recording Recording) {
+	line, err := json.Marshal(recording)
+	if err != nil {
+		log.Printf("Warning: encoding recording failed: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.out.Write(line); err != nil {
+		log.Printf("Warning: writing recording failed: %v", err)
+	}
+}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(code int) {
+	if rw.status == 0 {
+		rw.status = code
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// recordingMiddleware writes every chat completion request and its response
+// to RECORD_FILE so they can be replayed against another proxy build
+func recordingMiddleware(path string, next http.Handler) http.Handler {
+	out, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Fatalf("Error opening RECORD_FILE: %v", err)
+	}
+	file := &recordFile{out: out}
+	log.Printf("Recording chat completions to %s", path)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/chat/completions" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Error reading request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		recorder := &recordingWriter{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		file.write(Recording{
+			Timestamp: start.UTC().Format(time.RFC3339Nano),
+			RequestID: requestIDFrom(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Model:     summaryFrom(r.Context()).model,
+			Request:   string(body),
+			Status:    recorder.status,
+			Response:  recorder.body.String(),
+		})
+	})
+}
+
+// auditRemoteAddr returns the client host, hashed when AUDIT_HASH_IP is set
+func auditRemoteAddr(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if !auditHashIP {
+		return host
+	}
+	sum := sha256.Sum256([]byte(host))
+	return hex.EncodeToString(sum[:])
+}
+
+// tracer creates the proxy spans. It stays a no-op until initTracing
+// installs an exporting provider.
+var tracer = otel.Tracer("cursor-openrouter-proxy")
+
+// initTracing exports spans over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT
+// when it is set, and returns the function flushing the spans still batched
+// on exit. W3C trace context is always propagated so upstream calls join the
+// caller's trace.
+func initTracing() func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+	// The exporter reads the OTEL_EXPORTER_OTLP_* variables itself
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		log.Printf("Warning: tracing disabled, creating the OTLP exporter failed: %v", err)
+		return func(context.Context) error { return nil }
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(otelResource()),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("cursor-openrouter-proxy")
+	log.Printf("Exporting traces to %s", endpoint)
+	return provider.Shutdown
+}
+
+// otelResource describes the proxy in exported traces and metrics
+func otelResource() *resource.Resource {
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "cursor-openrouter-proxy"
+	}
+	return resource.NewSchemaless(attribute.String("service.name", serviceName))
+}
+
+// requestIDMiddleware makes sure every request has an X-Request-ID, generated
+// when the client sent none. The ID is echoed in the response and stored in
+// the request context for logging and forwarding upstream.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDFrom returns the request ID stored in ctx, if any
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// reqLog logs a line prefixed with the request ID found in ctx
+func reqLog(ctx context.Context, format string, args ...interface{}) {
+	if id := requestIDFrom(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Output(2, fmt.Sprintf(format, args...))
+}
+
+// reqDebugLog is the debug mode counterpart of reqLog
+func reqDebugLog(ctx context.Context, format string, args ...interface{}) {
+	if debugMode {
+		if id := requestIDFrom(ctx); id != "" {
+			format = "[" + id + "] " + format
+		}
+		log.Output(2, fmt.Sprintf(format, args...))
+	}
+}
+
+func main() {
+	validate := flag.Bool("validate", false, "check the configuration (environment, .env and proxy.yaml) and exit")
+	flag.Parse()
+	if *validate {
+		os.Exit(runValidate())
+	}
+
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
+
+	shutdownTracing := initTracing()
+	watchReloadSignal()
+	watchProviderHealth()
+	if (len(tokenBudgets) > 0 || costBudgetUSD > 0) && os.Getenv("BUDGET_RESET") != "false" {
+		resetBudgetsDaily()
+	}
+
+	requestQueue = newPriorityQueue(envInt("QUEUE_DEPTH", 100), envInt("QUEUE_WORKERS", 10))
+
+	if os.Getenv("SESSION_STORE") == "true" {
+		sessions = newSessionStore(time.Duration(envInt("SESSION_TTL_MINUTES", 30))*time.Minute, envInt("SESSION_MAX_TOKENS", 4000))
+		log.Printf("Session store enabled (X-Session-ID)")
+	}
+
+	// Pre-warm the models and capability caches; failures are retried on the
+	// first request
+	go func() {
+		if _, _, err := refreshModels(); err != nil {
+			log.Printf("Warning: pre-warming models cache failed: %v", err)
+		}
+	}()
+	refreshCapabilitiesPeriodically()
+
+	if latencyRouter != nil {
+		latencyRouter.probeLatencyPeriodically(time.Duration(envInt("LATENCY_PROBE_INTERVAL_SECONDS", 60)) * time.Second)
+		log.Printf("Latency routing across %s", strings.Join(latencyRouter.models, ", "))
+	}
+
+	if path := os.Getenv("AUDIT_LOG_FILE"); path != "" {
+		auditLog = newAuditLogger(path)
+		log.Printf("Writing audit log to %s", path)
+	}
+	if path := os.Getenv("SLOW_LOG_FILE"); path != "" {
+		slowLog = &lumberjack.Logger{Filename: path, MaxSize: 100, Compress: true}
+		log.Printf("Writing slow requests to %s", path)
+	}
+
+	var handler http.Handler = http.HandlerFunc(proxyHandler)
+	if len(sniTenants) > 0 {
+		handler = sniTenantMiddleware(handler)
+	}
+	if path := os.Getenv("RECORD_FILE"); path != "" {
+		handler = recordingMiddleware(path, handler)
+	}
+	handler = Chain(handler,
+		RecoveryMiddleware(),
+		RequestIDMiddleware(),
+		LoggingMiddleware(),
+		VersionMiddleware(),
+		CORSMiddleware(),
+		RateLimitMiddleware(),
+		AuthMiddleware(),
+		requireJSON,
+		decompressRequest,
+	)
+	server := &http.Server{
+		Addr:    ":9000",
+		Handler: handler,
+	}
+
+	if addr := os.Getenv("GRPC_ADDR"); addr != "" {
+		if err := startGRPCServer(addr, handler); err != nil {
+			log.Fatalf("Error starting gRPC server: %v", err)
+		}
+	}
+
+	// Serve TLS when a certificate is configured; the certificate is always
+	// read through serverCert so renewed files are picked up without a restart
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	useTLS := certFile != "" && keyFile != ""
+	if useTLS {
+		if err := serverCert.load(certFile, keyFile); err != nil {
+			log.Fatalf("Error loading TLS certificate: %v", err)
+		}
+		if err := watchCertFiles(certFile, keyFile); err != nil {
+			log.Printf("Warning: TLS certificate hot reload disabled: %v", err)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: serverCert.GetCertificate}
+		if len(sniTenants) > 0 {
+			server.TLSConfig.GetConfigForClient = tenantTLSConfig(&server.TLSConfig)
+		}
+	}
+
+	// Enable HTTP/2 support. This always sets server.TLSConfig, so it cannot
+	// tell whether TLS is enabled.
+	http2.ConfigureServer(server, &http2.Server{})
+
+	listener, err := listen(server.Addr)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", server.Addr, err)
+	}
+
+	// Stop on SIGINT or SIGTERM once the requests in progress are done, so
+	// the telemetry still batched in memory can be flushed
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Warning: shutting down the server: %v", err)
+		}
+	}()
+
+	logStartupSummary(activeState.Load(), server.Addr, useTLS)
+	log.Printf("Starting proxy server on %s (TLS: %t)", server.Addr, useTLS)
+	if useTLS {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Server failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("Warning: flushing traces: %v", err)
+	}
+}
+
+// shutdownTimeout bounds the wait for requests in progress, and then for the
+// telemetry flush, when the proxy stops
+const shutdownTimeout = 10 * time.Second
+
+// logStartupSummary logs the effective configuration as one JSON line, so a
+// deployment can be checked at a glance. The API key is masked.
+func logStartupSummary(state *configState, addr string, useTLS bool) {
+	cfg := state.config
+	retryStrategyName := os.Getenv("RETRY_STRATEGY")
+	if retryStrategyName == "" {
+		retryStrategyName = "exponential"
+	}
+	clientKeys := "sk-*"
+	if allowAnthropicKeys {
+		clientKeys = "sk-* including sk-ant-*"
+	}
+	fallbacks := state.fallbackModels
+	if fallbacks == nil {
+		fallbacks = []string{}
+	}
+	line, _ := json.Marshal(map[string]interface{}{
+		"version":         version,
+		"listen_addr":     addr,
+		"tls":             useTLS,
+		"endpoint":        cfg.endpoint,
+		"model":           cfg.model,
+		"fallback_models": fallbacks,
+		"api_key":         maskAPIKey(cfg.apiKey),
+		"rate_limit": map[string]interface{}{
+			"enabled":      globalRateLimit > 0 || len(keyRateLimits) > 0,
+			"rps_shared":   globalRateLimit,
+			"keys_limited": len(keyRateLimits),
+		},
+		"auth": map[string]interface{}{
+			"client_keys":  clientKeys,
+			"config_token": configAuthToken != "",
+			"tenant_dir":   tenantDir != "",
+			"sni_tenants":  len(sniTenants),
+			"key_refresh":  keyRefreshURL != "",
+		},
+		"cors_origins": []string{corsAllowOrigin},
+		"retry": map[string]interface{}{
+			"max_retries":     upstreamMaxRetries,
+			"strategy":        retryStrategyName,
+			"retry_after_cap": retryAfterCap.String(),
+		},
+		"upstream_compression": !disableUpstreamCompression && !streamLargeResponses,
+	})
+	log.Printf("startup_summary %s", line)
+}
+
+// listen opens the server socket. With REUSEPORT the port is shared with
+// other proxy processes, so a new binary can bind it before the old one exits.
+func listen(addr string) (net.Listener, error) {
+	var config net.ListenConfig
+	if reusePort {
+		if reusePortSupported {
+			config.Control = reusePortControl
+			log.Printf("Sharing port %s with SO_REUSEPORT", addr)
+		} else {
+			log.Printf("Warning: REUSEPORT is only supported on Linux, using a normal listener")
+		}
+	}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+// grpcChatServer serves proto/chat.proto by replaying each call as a
+// /v1/chat/completions request through the HTTP handler chain, so model
+// rewriting, limits and logging behave exactly as over HTTP
+type grpcChatServer struct {
+	chat_pb.UnimplementedChatServiceServer
+	handler http.Handler
+}
+
+// startGRPCServer listens on addr and serves the ChatService
+func startGRPCServer(addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	chat_pb.RegisterChatServiceServer(server, &grpcChatServer{handler: handler})
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Printf("Warning: gRPC server stopped: %v", err)
+		}
+	}()
+	log.Printf("Starting gRPC server on %s", addr)
+	return nil
+}
+
+// completionChoice is the part of an upstream completion or chunk read back
+// into a ChatResponse
+type completionChoice struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      Message `json:"message"`
+		Delta        Message `json:"delta"`
+		FinishReason string  `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int32 `json:"prompt_tokens"`
+		CompletionTokens int32 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (c completionChoice) response(stream bool) *chat_pb.ChatResponse {
+	resp := &chat_pb.ChatResponse{Id: c.ID, Model: c.Model}
+	if len(c.Choices) > 0 {
+		choice := c.Choices[0]
+		if stream {
+			resp.Content = choice.Delta.Content.String()
+		} else {
+			resp.Content = choice.Message.Content.String()
+		}
+		resp.FinishReason = choice.FinishReason
+	}
+	if c.Usage != nil {
+		resp.PromptTokens = c.Usage.PromptTokens
+		resp.CompletionTokens = c.Usage.CompletionTokens
+	}
+	return resp
+}
+
+// newGRPCHTTPRequest builds the HTTP request replaying a gRPC call. The
+// authorization and x-request-id metadata become the matching headers.
+func newGRPCHTTPRequest(ctx context.Context, in *chat_pb.ChatRequest, stream bool) (*http.Request, error) {
+	chatReq := ChatRequest{Model: in.Model, Stream: stream, Temperature: in.Temperature}
+	for _, msg := range in.Messages {
+		chatReq.Messages = append(chatReq.Messages, Message{Role: msg.Role, Content: ContentField{Text: msg.Content}})
+	}
+	if in.MaxTokens != nil {
+		maxTokens := int(*in.MaxTokens)
+		chatReq.MaxTokens = &maxTokens
+	}
+	body, err := json.Marshal(chatReq)
+	if err != nil {
+		return nil, status.Errorf(grpccodes.InvalidArgument, "encoding request: %v", err)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Errorf(grpccodes.Internal, "building request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for header, key := range map[string]string{"Authorization": "authorization", "X-Request-ID": "x-request-id"} {
+			if values := md.Get(key); len(values) > 0 {
+				r.Header.Set(header, values[0])
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	return r, nil
+}
+
+// grpcResponseWriter collects what the HTTP handler writes. When onEvent is
+// set, successful SSE data lines are handed to it as they arrive.
+type grpcResponseWriter struct {
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+	onEvent func(data []byte) error
+}
+
+func (g *grpcResponseWriter) Header() http.Header {
+	return g.header
+}
+
+func (g *grpcResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *grpcResponseWriter) Write(b []byte) (int, error) {
+	g.WriteHeader(http.StatusOK)
+	g.body.Write(b)
+	if g.onEvent == nil || g.status != http.StatusOK {
+		return len(b), nil
+	}
+
+	// Hand over complete lines only, keeping a partial one for the next write
+	for {
+		line, err := g.body.ReadBytes('\n')
+		if err != nil {
+			g.body.Write(line)
+			return len(b), nil
+		}
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("data:")) || isDoneSentinel(line) {
+			continue
+		}
+		if err := g.onEvent(bytes.TrimSpace(line[len("data:"):])); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (g *grpcResponseWriter) Flush() {}
+
+// err converts an error response of the HTTP handler to a gRPC status
+func (g *grpcResponseWriter) err() error {
+	if g.status == 0 || g.status < 400 {
+		return nil
+	}
+	message := http.StatusText(g.status)
+	var errResp struct {
+		Error APIError `json:"error"`
+	}
+	if json.Unmarshal(g.body.Bytes(), &errResp) == nil && errResp.Error.Message != "" {
+		message = errResp.Error.Message
+	}
+	return status.Error(grpcCodeForStatus(g.status), message)
+}
+
+// grpcCodeForStatus maps an HTTP status to the closest gRPC code
+func grpcCodeForStatus(httpStatus int) grpccodes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return grpccodes.InvalidArgument
+	case http.StatusUnauthorized:
+		return grpccodes.Unauthenticated
+	case http.StatusForbidden:
+		return grpccodes.PermissionDenied
+	case http.StatusNotFound:
+		return grpccodes.NotFound
+	case http.StatusPaymentRequired, http.StatusTooManyRequests:
+		return grpccodes.ResourceExhausted
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return grpccodes.Unavailable
+	default:
+		return grpccodes.Internal
+	}
+}
+
+func (s *grpcChatServer) Complete(ctx context.Context, in *chat_pb.ChatRequest) (*chat_pb.ChatResponse, error) {
+	r, err := newGRPCHTTPRequest(ctx, in, false)
+	if err != nil {
+		return nil, err
+	}
+	w := &grpcResponseWriter{header: make(http.Header)}
+	s.handler.ServeHTTP(w, r)
+	if err := w.err(); err != nil {
+		return nil, err
+	}
+
+	var completion completionChoice
+	if err := json.Unmarshal(w.body.Bytes(), &completion); err != nil {
+		return nil, status.Errorf(grpccodes.Internal, "decoding upstream response: %v", err)
+	}
+	return completion.response(false), nil
+}
+
+func (s *grpcChatServer) StreamComplete(in *chat_pb.ChatRequest, stream chat_pb.ChatService_StreamCompleteServer) error {
+	r, err := newGRPCHTTPRequest(stream.Context(), in, true)
+	if err != nil {
+		return err
+	}
+	w := &grpcResponseWriter{header: make(http.Header), onEvent: func(data []byte) error {
+		var chunk completionChoice
+		if err := json.Unmarshal(data, &chunk); err != nil {
+			// Not a completion chunk (e.g. an error event), skip it
+			return nil
+		}
+		return stream.Send(chunk.response(true))
+	}}
+	s.handler.ServeHTTP(w, r)
+	return w.err()
+}
+
+// certStore holds the TLS certificate served by the proxy
+type certStore struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+var serverCert certStore
+
+func (c *certStore) load(certFile, keyFile string) error {
+	_, err := c.reload(certFile, keyFile)
+	return err
+}
+
+// reload loads the certificate pair and reports whether it differs from the
+// one served so far. On error the current certificate is kept.
+func (c *certStore) reload(certFile, keyFile string) (bool, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && bytes.Equal(c.cert.Certificate[0], cert.Certificate[0]) {
+		return false, nil
+	}
+	c.cert = &cert
+	return true, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return c.cert, nil
+}
+
+// watchCertFiles reloads serverCert on any change in the directories of the
+// certificate and key files. Events are not matched against the file names:
+// atomic replacements (rename, symlink swap as done for Kubernetes secrets)
+// change other entries of the directory.
+func watchCertFiles(certFile, keyFile string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := map[string]bool{filepath.Dir(certFile): true, filepath.Dir(keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// A mismatched pair is expected while only one file has been
+				// replaced; the current certificate is kept until both match
+				changed, err := serverCert.reload(certFile, keyFile)
+				if err != nil {
+					log.Printf("Error reloading TLS certificate: %v", err)
+					continue
+				}
+				if changed {
+					log.Printf("Reloaded TLS certificate from %s", certFile)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching TLS certificate files: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Error types used in OpenAI-style error responses
+const (
+	errTypeInvalidRequest = "invalid_request_error"
+	errTypeAuthentication = "authentication_error"
+	errTypeRateLimit      = "rate_limit_error"
+	errTypeServer         = "server_error"
+	errTypeBudgetExceeded = "budget_exceeded"
+	errTypeMaxRounds      = "max_rounds_exceeded"
+
+	errTypeServiceUnavailable = "service_unavailable"
+)
+
+// APIError is the error object of an OpenAI-style error response
+type APIError struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Code    interface{} `json:"code"`
+	Param   *string     `json:"param"`
+
+	// Details OpenRouter adds to upstream errors, such as provider_name and
+	// the raw provider error, forwarded as is
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// Prometheus metrics, served on GET /metrics
+var (
+	metricsRegistry *prometheus.Registry
+
+	// Time until the upstream response (first SSE data chunk when streaming)
+	upstreamLatency *prometheus.HistogramVec
+
+	// Total duration of streamed responses
+	streamDuration *prometheus.SummaryVec
+
+	// Time from upstream connection to the first SSE data chunk
+	ttftSeconds *prometheus.HistogramVec
+
+	// Requests currently holding a concurrency slot
+	queuedRequests prometheus.Gauge
+
+	// SSE chunks dropped by VALIDATE_SSE_JSON
+	invalidSSEChunks prometheus.Counter
+
+	// Streams ended by an error chunk from the upstream
+	streamErrors prometheus.Counter
+)
+
+var defaultLatencyBuckets = []float64{0.1, 0.5, 1, 2, 5, 10, 30, 60}
+
+// expvar variables, served on GET /debug/vars with ENABLE_DEBUG_ENDPOINT
+// next to the memstats and cmdline published by the expvar package
+var (
+	processStart = time.Now()
+
+	requestsTotal = expvar.NewInt("proxy_requests_total")
+	activeStreams = expvar.NewInt("proxy_active_streams")
+)
+
+// publishExpvars publishes the expvar variables computed on each read
+func publishExpvars() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("active_model", expvar.Func(func() interface{} {
+		return activeState.Load().config.model
+	}))
+	expvar.Publish("uptime_seconds", expvar.Func(func() interface{} {
+		return time.Since(processStart).Seconds()
+	}))
+}
+
+// initMetrics creates and registers the proxy metrics
+func initMetrics() {
+	metricsRegistry = prometheus.NewRegistry()
+	buckets := latencyBuckets()
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_upstream_latency_seconds",
+		Help:    "Upstream response latency; time to first SSE data chunk for streaming requests.",
+		Buckets: buckets,
+	}, []string{"model", "stream"})
+
+	streamDuration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name:       "proxy_stream_duration_seconds",
+		Help:       "Total duration of streamed responses.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	}, []string{"model"})
+
+	ttftSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_ttft_seconds",
+		Help:    "Time to first token of streamed responses.",
+		Buckets: buckets,
+	}, []string{"model"})
+
+	queuedRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "proxy_queued_requests",
+		Help: "Requests currently holding one of the MAX_CONCURRENT_REQUESTS slots.",
+	})
+
+	invalidSSEChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_invalid_sse_chunks_total",
+		Help: "SSE data chunks dropped because their payload is not valid JSON.",
+	})
+
+	streamErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "proxy_stream_errors_total",
+		Help: "Streams ended because the upstream sent an error chunk.",
+	})
+
+	metricsRegistry.MustRegister(upstreamLatency, streamDuration, ttftSeconds, queuedRequests, invalidSSEChunks, streamErrors)
+
+	initOTelMetrics()
+}
+
+// latencyBuckets parses LATENCY_HISTOGRAM_BUCKETS, falling back to the
+// defaults when it is unset or invalid
+func latencyBuckets() []float64 {
+	value := os.Getenv("LATENCY_HISTOGRAM_BUCKETS")
+	if value == "" {
+		return defaultLatencyBuckets
+	}
+	var buckets []float64
+	for _, item := range splitList(value) {
+		bound, err := strconv.ParseFloat(item, 64)
+		if err != nil || (len(buckets) > 0 && bound <= buckets[len(buckets)-1]) {
+			log.Printf("Warning: invalid LATENCY_HISTOGRAM_BUCKETS %q, using defaults", value)
+			return defaultLatencyBuckets
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets
+}
+
+// writeError writes an OpenAI-style JSON error response
+func writeError(w http.ResponseWriter, status int, errType, message string) {
+	writeAPIError(w, status, APIError{
+		Message: message,
+		Type:    errType,
+		Code:    status,
+	})
+}
+
+// errorBody encodes an OpenAI-style error body for responses written later
+func errorBody(status int, errType, message string) []byte {
+	body, _ := json.Marshal(map[string]APIError{"error": {
+		Message: message,
+		Type:    errType,
+		Code:    status,
+	}})
+	return body
+}
+
+func writeAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]APIError{"error": apiErr})
+}
+
+// errorTypeForStatus maps an HTTP status to the matching OpenAI error type
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errTypeAuthentication
+	case status == http.StatusTooManyRequests:
+		return errTypeRateLimit
+	case status >= 500:
+		return errTypeServer
+	default:
+		return errTypeInvalidRequest
+	}
+}
+
+// corsAllowOrigin is the Access-Control-Allow-Origin of every response
+const corsAllowOrigin = "*"
+
+func enableCors(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", corsAllowOrigin)
+	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, Authorization, X-Request-ID, X-Proxy-Model, X-Fallback-Model, X-Priority, X-Tenant-ID, X-Async, X-Session-ID, X-Provider-Preferences, X-Transforms, X-OpenRouter-Route, X-Proxy-Max-Retries, Idempotency-Key")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Request-ID, X-Proxy-Version, X-Proxy-Cache, X-OpenRouter-Generation-ID, "+
+		"X-Proxy-Model-Rewritten, X-Proxy-Deduplicated, X-Proxy-Idempotent, X-Proxy-Recovered, X-Proxy-Fallback-Used, X-Proxy-Fallback-Model, "+
+		"X-Proxy-Model-Override, X-Proxy-Deprecation-Warning, X-Proxy-TTFT-Ms, X-RateLimit-Remaining, Deprecation")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
+
+// maskAPIKey keeps at most the first and last 6 characters of a key. Masking
+// an already masked key returns it unchanged.
+func maskAPIKey(key string) string {
+	if key == "***" || (len(key) == 15 && key[6:9] == "...") {
+		return key
+	}
+	if len(key) <= 12 {
+		return "***"
+	}
+	return key[:6] + "..." + key[len(key)-6:]
+}
+
+// maskHeaders returns a copy of h suitable for logging, with bearer tokens masked
+func maskHeaders(h http.Header) http.Header {
+	masked := h.Clone()
+	if auth := masked.Get("Authorization"); auth != "" {
+		masked.Set("Authorization", "Bearer "+maskAPIKey(strings.TrimPrefix(auth, "Bearer ")))
+	}
+	return masked
+}
+
+// adminRoutes are the endpoints served by the proxy itself rather than
+// forwarded upstream, keyed by "METHOD path". They need no client API key;
+// the config endpoints check CONFIG_AUTH_TOKEN themselves.
+var adminRoutes = map[string]http.HandlerFunc{
+	"GET /v1/config":           handleGetConfigRequest,
+	"POST /v1/config":          handleConfigRequest,
+	"PATCH /v1/config":         handlePatchConfigRequest,
+	"GET /v1/config/export":    handleExportConfigRequest,
+	"GET /v1/config/list":      handleListConfigsRequest,
+	"GET /v1/config/history":   handleGetConfigHistoryRequest,
+	"POST /v1/config/import":   handleImportConfigRequest,
+	"POST /v1/config/activate": handleActivateConfigRequest,
+	"GET /v1/models":           func(w http.ResponseWriter, r *http.Request) { handleGetModelsRequest(w) },
+	"GET /v1/capabilities":     func(w http.ResponseWriter, r *http.Request) { handleGetCapabilitiesRequest(w) },
+	"GET /v1/budget":           handleGetBudgetRequest,
+	"GET /v1/stats":            handleGetStatsRequest,
+	"GET /v1/latency":          func(w http.ResponseWriter, r *http.Request) { handleGetLatencyRequest(w) },
+	"GET /v1/providers":        func(w http.ResponseWriter, r *http.Request) { handleGetProvidersRequest(w) },
+	"POST /v1/benchmark":       handleBenchmarkRequest,
+	"GET /v1/echo":             handleEchoRequest,
+	"POST /v1/echo":            handleEchoRequest,
+	"GET /healthz":             func(w http.ResponseWriter, r *http.Request) { handleLivenessRequest(w) },
+	"GET /readyz":              handleReadyzRoute,
+	"GET /health":              handleReadyzRoute,
+	"GET /debug/vars":          handleDebugVarsRoute,
+	"GET /openapi.json":        func(w http.ResponseWriter, r *http.Request) { handleOpenAPIRequest(w) },
+	"GET /metrics":             handleMetricsRoute,
+}
+
+// handleReadyzRoute serves the readiness probe; /health is a deprecated
+// alias of /readyz
+func handleReadyzRoute(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		w.Header().Set("Deprecation", "true")
+	}
+	pushModels(w, r)
+	handleReadinessRequest(w)
+}
+
+func handleDebugVarsRoute(w http.ResponseWriter, r *http.Request) {
+	if !enableDebugEndpoint {
+		writeError(w, http.StatusNotFound, errTypeInvalidRequest, "Not found")
+		return
+	}
+	if checkConfigAuth(w, r) {
+		expvar.Handler().ServeHTTP(w, r)
+	}
+}
+
+// handleEchoRequest reflects the request as the proxy received it: protocol,
+// headers (bearer token masked) and the first MiB of the body, base64 encoded
+func handleEchoRequest(w http.ResponseWriter, r *http.Request) {
+	if !enableEcho {
+		writeError(w, http.StatusNotFound, errTypeInvalidRequest, "Not found")
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Error reading request body")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"headers":     maskHeaders(r.Header),
+		"body":        body,
+		"remote_addr": r.RemoteAddr,
+		"proto":       r.Proto,
+	})
+}
+
+func handleMetricsRoute(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	reqDebugLog(r.Context(), "Received request: %s %s", r.Method, r.URL.Path)
+
+	if route, ok := adminRoutes[r.Method+" "+r.URL.Path]; ok {
+		route(w, r)
+		return
+	}
+
+	// Only handle API requests with /v1/ prefix
+	if !strings.HasPrefix(r.URL.Path, "/v1/") {
+		reqLog(r.Context(), "Invalid path: %s", r.URL.Path)
+		writeError(w, http.StatusNotFound, errTypeInvalidRequest, "Not found")
+		return
+	}
+
+	// The key was checked and rate limited by AuthMiddleware and
+	// RateLimitMiddleware
+	userAPIKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	// Batches take no slot themselves, each of their requests does
+	if r.URL.Path == "/v1/chat/completions/batch" && r.Method == "POST" {
+		handleBatchRequest(w, r)
+		return
+	}
+
+	// Polling an async job only reads its stored response, so it takes no
+	// slot either
+	if strings.HasPrefix(r.URL.Path, "/v1/jobs/") && r.Method == "GET" {
+		handleGetJobRequest(w, strings.TrimPrefix(r.URL.Path, "/v1/jobs/"))
+		return
+	}
+
+	// Bound the number of requests in flight. An async job runs in the slot
+	// handed over by the request that started it.
+	var releaseSlot func()
+	if !asyncJobFrom(r.Context()) {
+		slots := semaphore
+		select {
+		case slots <- struct{}{}:
+			queuedRequests.Inc()
+			releaseSlot = func() {
+				<-slots
+				queuedRequests.Dec()
+			}
+			defer func() {
+				if releaseSlot != nil {
+					releaseSlot()
+				}
+			}()
+		default:
+			reqLog(r.Context(), "Proxy at capacity, rejecting request")
+			writeError(w, http.StatusServiceUnavailable, errTypeServiceUnavailable, "proxy at capacity")
+			return
+		}
+	}
+
+	// Refuse keys that used up their token budget
+	keyHash := hashKey(strings.TrimSpace(userAPIKey))
+	if budgetExceeded(keyHash) {
+		reqLog(r.Context(), "Token budget exceeded for key %s", maskAPIKey(strings.TrimSpace(userAPIKey)))
+		writeError(w, http.StatusPaymentRequired, errTypeBudgetExceeded, "token budget exceeded")
+		return
+	}
+
+	// Read and log request body for debugging
+	var chatReq ChatRequest
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		reqDebugLog(r.Context(), "Error reading request body: %v", err)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Error reading request")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewBuffer(body))
+
+	if err := json.Unmarshal(body, &chatReq); err != nil {
+		reqLog(r.Context(), "Error parsing request JSON: %v", err)
+		reqDebugLog(r.Context(), "Raw request body: %s", string(body))
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Invalid JSON")
+		return
+	}
+
+	reqDebugLog(r.Context(), "Parsed request: %+v", sanitizeForLog(chatReq))
+
+	// Provider routing may also come as JSON in X-Provider-Preferences, for
+	// clients that cannot add body fields; the body wins
+	if value := r.Header.Get("X-Provider-Preferences"); value != "" {
+		var preferences *ProviderPreferences
+		if err := json.Unmarshal([]byte(value), &preferences); err != nil {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "X-Provider-Preferences must be a JSON provider object")
+			return
+		}
+		chatReq.Provider = mergeProviderPreferences(preferences, chatReq.Provider)
+	}
+
+	// Transforms may likewise come as a comma-separated X-Transforms header
+	if value := r.Header.Get("X-Transforms"); value != "" && chatReq.Transforms == nil {
+		chatReq.Transforms = splitList(value)
+	}
+	if value := r.Header.Get("X-OpenRouter-Route"); value != "" && chatReq.Route == "" {
+		chatReq.Route = value
+	}
+
+	// Stop conversations where the model keeps calling tools without ever
+	// answering
+	if rounds := conversationToolRounds(chatReq.Messages); rounds > maxToolRounds {
+		reqLog(r.Context(), "Rejecting request after %d consecutive tool call rounds", rounds)
+		writeError(w, http.StatusBadRequest, errTypeMaxRounds, errMaxToolRounds.Error())
+		return
+	}
+
+	// Process X-Async requests in the background and return a job ID
+	if r.Header.Get("X-Async") == "true" && !chatReq.Stream {
+		jobID := startAsyncJob(r, body, releaseSlot)
+		releaseSlot = nil
+		reqLog(r.Context(), "Started async job %s", jobID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"job_id": jobID})
+		return
+	}
+
+	summary := summaryFrom(r.Context())
+	summary.parsed(len(body), chatReq.Stream)
+	summary.modelRequested = chatReq.Model
+	summary.messageCount = len(chatReq.Messages)
+	for i := len(chatReq.Messages) - 1; i >= 0; i-- {
+		if chatReq.Messages[i].Role == "user" {
+			summary.lastUserMessage = hashKey(chatReq.Messages[i].Content.String())
+			break
+		}
+	}
+
+	// Replay the response of an earlier request with the same
+	// Idempotency-Key, so a client retry is not sent upstream and billed again
+	if key := r.Header.Get("Idempotency-Key"); key != "" && !chatReq.Stream {
+		if len(key) > 64 {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Idempotency-Key must be at most 64 characters")
+			return
+		}
+		storeKey := keyHash + ":" + key
+		marker := &idempotentResponse{bodyHash: sha256.Sum256(body)}
+		stored, loaded := idempotencyStore.LoadOrStore(storeKey, marker)
+		response := stored.(*idempotentResponse)
+		if loaded && response.status != 0 && !time.Now().Before(response.expires) {
+			// An expired response not deleted yet
+			idempotencyStore.Store(storeKey, marker)
+			loaded = false
+		}
+		if loaded {
+			switch {
+			case response.bodyHash != marker.bodyHash:
+				writeError(w, http.StatusConflict, errTypeInvalidRequest, "Idempotency-Key was already used with a different request body")
+			case response.status == 0:
+				writeError(w, http.StatusConflict, errTypeInvalidRequest, "A request with this Idempotency-Key is already in progress")
+			default:
+				reqLog(r.Context(), "Replaying the response of Idempotency-Key %s", key)
+				w.Header().Set("Content-Type", response.contentType)
+				w.Header().Set("X-Proxy-Idempotent", "true")
+				w.WriteHeader(response.status)
+				w.Write(response.body)
+			}
+			return
+		}
+		capture := &captureWriter{ResponseWriter: w}
+		w = capture
+		defer storeIdempotentResponse(storeKey, marker, capture)
+	}
+
+	// Share the response of an identical request already in flight
+	if deduplicationEnabled && !chatReq.Stream {
+		fingerprint := requestFingerprint(r, body)
+		pending := &pendingRequest{started: time.Now(), done: make(chan struct{})}
+		if existing, loaded := pendingRequests.LoadOrStore(fingerprint, pending); loaded {
+			leader := existing.(*pendingRequest)
+			if time.Since(leader.started) < deduplicationWindow {
+				reqDebugLog(r.Context(), "Waiting for identical request in flight")
+				select {
+				case <-leader.done:
+					w.Header().Set("Content-Type", leader.contentType)
+					w.Header().Set("X-Proxy-Deduplicated", "true")
+					w.WriteHeader(leader.status)
+					w.Write(leader.response)
+					return
+				case <-r.Context().Done():
+					return
+				case <-time.After(deduplicationWait):
+					reqLog(r.Context(), "Identical request still in flight after %s, sending upstream", deduplicationWait)
+				}
+			}
+		} else {
+			capture := &captureWriter{ResponseWriter: w}
+			w = capture
+			defer func() {
+				pending.response = capture.body.Bytes()
+				pending.status = capture.status
+				if pending.status == 0 {
+					pending.status = http.StatusOK
+				}
+				pending.contentType = capture.Header().Get("Content-Type")
+				pendingRequests.Delete(fingerprint)
+				close(pending.done)
+			}()
+		}
+	}
+
+	// Tenants configured in TENANT_DIR or selected by hostname use their own
+	// key and models
+	state := activeState.Load()
+	upstream := state.config
+	fallbacks := state.fallbackModels
+	selector := state.selector
+	latency := latencyRouter
+	tenant, tenantID := sniTenantFrom(r.Context()), r.Host
+	if id := r.Header.Get("X-Tenant-ID"); id != "" && tenantDir != "" {
+		var err error
+		tenant, err = tenantConfigFor(id)
+		if err != nil {
+			reqLog(r.Context(), "Error loading tenant %s: %v", id, err)
+			writeError(w, http.StatusForbidden, errTypeAuthentication, "Unknown or invalid tenant")
+			return
+		}
+		tenantID = id
+	}
+	if tenant != nil {
+		upstream.apiKey = tenant.APIKey
+		if tenant.Model != "" {
+			upstream.model = tenant.Model
+			selector = nil
+			latency = nil
+		}
+		if len(tenant.FallbackModels) > 0 {
+			fallbacks = tenant.FallbackModels
+		}
+		reqDebugLog(r.Context(), "Using tenant %s (model: %s, key: %s)", tenantID, upstream.model, maskAPIKey(tenant.APIKey))
+	}
+
+	// Pick the model serving this request: an X-Proxy-Model override first,
+	// then a matching routing rule, then the fastest model when
+	// LATENCY_ROUTING_MODELS is set, then the weighted selector when
+	// OPENROUTER_MODELS is set
+	model := upstream.model
+	if override := r.Header.Get("X-Proxy-Model"); override != "" && allowModelOverride {
+		override = resolveAlias(override, modelAliases)
+		if !strings.Contains(override, "/") {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "X-Proxy-Model must contain a provider prefix (e.g. openai/gpt-4o)")
+			return
+		}
+		reqDebugLog(r.Context(), "Model overridden by X-Proxy-Model: %s", override)
+		w.Header().Set("X-Proxy-Model-Override", "true")
+		model = override
+	} else if routed := routeByContent(chatReq.Messages); routed != "" {
+		reqDebugLog(r.Context(), "Routing rule selected model %s", routed)
+		model = routed
+	} else if fastest := latency.fastest(); fastest != "" {
+		reqDebugLog(r.Context(), "Latency routing selected model %s", fastest)
+		model = fastest
+	} else if selector != nil {
+		model = selector.Select()
+	}
+
+	// Reroute away from providers in an outage
+	if !providerHealthy(extractProvider(model)) {
+		if healthy := firstHealthyFallback(fallbacks); healthy != "" {
+			reqLog(r.Context(), "Provider %s is unhealthy, rerouting to %s", extractProvider(model), healthy)
+			model = healthy
+		}
+	}
+
+	// Optional model to retry with when the upstream rejects this one
+	fallbackModel := r.Header.Get("X-Fallback-Model")
+	if fallbackModel != "" {
+		fallbackModel = resolveAlias(fallbackModel, modelAliases)
+		if !strings.Contains(fallbackModel, "/") {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "X-Fallback-Model must contain a provider prefix (e.g. openai/gpt-4o)")
+			return
+		}
+	}
+
+	// Replace the mocked model with the configured model
+	if isMockedModel(chatReq.Model) {
+		reqDebugLog(r.Context(), "Converting %s to configured model: %s (endpoint: %s)", chatReq.Model, model, upstream.endpoint)
+		chatReq.Model = model
+		reqDebugLog(r.Context(), "Model converted to: %s", model)
+	} else if allowFineTunedModels && strings.HasPrefix(chatReq.Model, "ft:") {
+		// Fine-tuned IDs are forwarded as-is and have no provider prefix
+		reqDebugLog(r.Context(), "Passing fine-tuned model through: %s", chatReq.Model)
+		model = chatReq.Model
+	} else if !openAIStrictMode {
+		// Clients other than Cursor name the OpenRouter model themselves
+		reqDebugLog(r.Context(), "Passing model through: %s", chatReq.Model)
+		model = chatReq.Model
+	} else {
+		reqLog(r.Context(), "Unsupported model requested: %s", chatReq.Model)
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, fmt.Sprintf("Model %s not supported. Use %s instead.", chatReq.Model, cursorMockedModel))
+		return
+	}
+
+	if deprecation, ok := deprecatedModels[model]; ok {
+		w.Header().Set("X-Proxy-Deprecation-Warning", deprecation.Warning(model))
+	}
+
+	// Prepend the stored history of the session; the messages of this turn
+	// are saved with the reply once the response is complete
+	sessionID := r.Header.Get("X-Session-ID")
+	if sessions == nil {
+		sessionID = ""
+	} else if sessionID != "" {
+		sessionID = keyHash + ":" + sessionID
+	}
+	turn := chatReq.Messages
+	if sessionID != "" {
+		if history := sessions.history(sessionID); len(history) > 0 {
+			reqDebugLog(r.Context(), "Prepending %d messages of session history", len(history))
+			chatReq.Messages = append(history, chatReq.Messages...)
+		}
+	}
+
+	if messages, removed := truncateMessages(chatReq.Messages, maxMessages, truncateStrategy); removed > 0 {
+		reqLog(r.Context(), "Truncated %d of %d messages (MAX_MESSAGES=%d)", removed, len(chatReq.Messages), maxMessages)
+		chatReq.Messages = messages
+	}
+
+	if systemPrompt != "" {
+		prompt := Message{Role: "system", Content: ContentField{Text: renderSystemPrompt(r.Context(), model, strings.TrimSpace(userAPIKey))}}
+		chatReq.Messages = append([]Message{prompt}, chatReq.Messages...)
+	}
+
+	openRouterReq := buildOpenRouterRequest(r.Context(), chatReq, model)
+
+	summary.model = model
+	summary.upstreamStart = time.Now()
+	resp, err := sendWithBuiltinTools(r, upstream, openRouterReq)
+	if errors.Is(err, errQueueFull) {
+		reqLog(r.Context(), "Request queue full, rejecting request")
+		writeError(w, http.StatusServiceUnavailable, errTypeServer, "Server busy, try again later")
+		return
+	}
+	if errors.Is(err, errMaxToolRounds) {
+		reqLog(r.Context(), "Builtin tool calls exceeded %d rounds", maxToolRounds)
+		writeError(w, http.StatusBadRequest, errTypeMaxRounds, err.Error())
+		return
+	}
+	recordProviderResult(model, resp, err)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			reqLog(r.Context(), "Client cancelled request before upstream responded")
+			return
+		}
+		reqLog(r.Context(), "Error forwarding request: %v", err)
+		writeError(w, http.StatusBadGateway, errTypeServer, "Error forwarding request")
+		return
+	}
+	defer resp.Body.Close()
+
+	if !chatReq.Stream {
+		summary.firstByte()
+	}
+
+	reqDebugLog(r.Context(), "OpenRouter response status: %d", resp.StatusCode)
+	reqDebugLog(r.Context(), "OpenRouter response headers: %v", resp.Header)
+
+	// A rejected key may have expired; retry once with a refreshed one. The
+	// original 401 is forwarded when the retry cannot be sent.
+	if resp.StatusCode == http.StatusUnauthorized && keyRefreshURL != "" && tenant == nil {
+		if key, ok := refreshAPIKey(r.Context(), upstream.apiKey); ok {
+			reqLog(r.Context(), "Retrying with the refreshed API key")
+			upstream.apiKey = key
+			retryResp, retryErr := sendWithBuiltinTools(r, upstream, openRouterReq)
+			if retryErr != nil {
+				reqLog(r.Context(), "Error retrying with the refreshed API key: %v", retryErr)
+			} else {
+				resp.Body.Close()
+				resp = retryResp
+				defer resp.Body.Close()
+			}
+		}
+	}
+
+	// Handle error responses, retrying once with the X-Fallback-Model when
+	// the error is model specific
+	if resp.StatusCode >= 400 {
+		respBody, err := readResponse(resp)
+		if err != nil {
+			reqLog(r.Context(), "Error reading error response: %v", err)
+			writeError(w, http.StatusInternalServerError, errTypeServer, "Error reading response")
+			return
+		}
+		reqLog(r.Context(), "Error response body: %s", string(respBody))
+
+		if fallbackModel == "" || !isFallbackError(resp.StatusCode, respBody) {
+			forwardRetryAfter(w, resp)
+			forwardUpstreamError(w, resp.StatusCode, respBody)
+			return
+		}
+
+		reqLog(r.Context(), "Retrying with fallback model %s after upstream status %d", fallbackModel, resp.StatusCode)
+		openRouterReq = buildOpenRouterRequest(r.Context(), chatReq, fallbackModel)
+		summary.model = fallbackModel
+		summary.upstreamStart = time.Now()
+		resp, err = sendWithBuiltinTools(r, upstream, openRouterReq)
+		if errors.Is(err, errQueueFull) {
+			reqLog(r.Context(), "Request queue full, rejecting fallback request")
+			writeError(w, http.StatusServiceUnavailable, errTypeServer, "Server busy, try again later")
+			return
+		}
+		if errors.Is(err, errMaxToolRounds) {
+			reqLog(r.Context(), "Builtin tool calls exceeded %d rounds", maxToolRounds)
+			writeError(w, http.StatusBadRequest, errTypeMaxRounds, err.Error())
+			return
+		}
+		recordProviderResult(fallbackModel, resp, err)
+		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				reqLog(r.Context(), "Client cancelled request before upstream responded")
+				return
+			}
+			reqLog(r.Context(), "Error forwarding fallback request: %v", err)
+			writeError(w, http.StatusBadGateway, errTypeServer, "Error forwarding request")
+			return
+		}
+		defer resp.Body.Close()
+
+		if !chatReq.Stream {
+			summary.firstByte()
+		}
+		w.Header().Set("X-Proxy-Fallback-Used", "true")
+		w.Header().Set("X-Proxy-Fallback-Model", fallbackModel)
+
+		if resp.StatusCode >= 400 {
+			respBody, err := readResponse(resp)
+			if err != nil {
+				reqLog(r.Context(), "Error reading error response: %v", err)
+				writeError(w, http.StatusInternalServerError, errTypeServer, "Error reading response")
+				return
+			}
+			reqLog(r.Context(), "Fallback error response body: %s", string(respBody))
+			forwardRetryAfter(w, resp)
+			forwardUpstreamError(w, resp.StatusCode, respBody)
+			return
+		}
+	}
+
+	// Tell the client whether another model than the one it asked for
+	// answers, the fallback included
+	w.Header().Set("X-Proxy-Model-Rewritten", strconv.FormatBool(openRouterReq.Model != summary.modelRequested))
+
+	// Responses report the model the client asked for; outside strict mode
+	// or without RESPONSE_MODEL_REWRITE the upstream model is reported
+	// unchanged
+	responseModel := summary.modelRequested
+	if !openAIStrictMode || !rewriteResponseModel {
+		responseModel = ""
+	}
+
+	// Handle streaming response
+	if chatReq.Stream {
+		if !rewriteStreamModel {
+			responseModel = ""
+		}
+		var counter *streamTokenCounter
+		emitUsage := countStreamTokens || providerIn(openRouterReq.Model, countStreamTokensProviders)
+		if emitUsage || sessionID != "" {
+			counter = &streamTokenCounter{messages: openRouterReq.Messages, model: openRouterReq.Model, emitUsage: emitUsage}
+		}
+		handleStreamingResponse(w, r, resp, counter, responseModel)
+		chargeBudget(keyHash, summary)
+		if counter != nil {
+			summary.completion = counter.completion.String()
+		}
+	} else {
+		handleRegularResponse(w, resp, responseModel)
+		chargeBudget(keyHash, summary)
+	}
+
+	if sessionID != "" && summary.completion != "" {
+		sessions.append(sessionID, turn, Message{Role: "assistant", Content: ContentField{Text: summary.completion}})
+	}
+}
+
+// buildOpenRouterRequest converts chatReq to the OpenRouter format for model,
+// applying the provider-specific adjustments
+func buildOpenRouterRequest(ctx context.Context, chatReq ChatRequest, model string) OpenRouterRequest {
+	openRouterReq := OpenRouterRequest{
+		Model:    model,
+		Messages: roleNormalizerForProvider(extractProvider(model))(convertMessages(chatReq.Messages)),
+		Stream:   chatReq.Stream,
+	}
+
+	// Provider-specific parameter constraints
+	constraints := constraintsFor(model)
+	if chatReq.Temperature != nil {
+		openRouterReq.Temperature = clampFloat(*chatReq.Temperature, constraints.MaxTemperature)
+	}
+	if chatReq.TopP != nil {
+		openRouterReq.TopP = clampFloat(*chatReq.TopP, constraints.MaxTopP)
+	}
+	if !constraints.OmitMaxTokens {
+		if chatReq.MaxTokens != nil {
+			maxTokens := *chatReq.MaxTokens
+			if constraints.MaxOutputTokens > 0 && maxTokens > constraints.MaxOutputTokens {
+				reqLog(ctx, "Warning: max_tokens %d exceeds the %d limit of %s, clamping", maxTokens, constraints.MaxOutputTokens, model)
+				maxTokens = constraints.MaxOutputTokens
+			}
+			openRouterReq.MaxTokens = maxTokens
+		} else if constraints.DefaultMaxTokens > 0 {
+			reqDebugLog(ctx, "Using default max_tokens %d for %s", constraints.DefaultMaxTokens, model)
+			openRouterReq.MaxTokens = constraints.DefaultMaxTokens
+		}
+	}
+
+	openRouterReq.ProviderPreferences = mergeProviderPreferences(defaultProviderPreferences, chatReq.Provider)
+	openRouterReq.Transforms = defaultTransforms
+	if chatReq.Transforms != nil {
+		openRouterReq.Transforms = chatReq.Transforms
+	}
+	openRouterReq.Route = defaultRoute
+	if chatReq.Route != "" {
+		if validRoute(chatReq.Route) {
+			openRouterReq.Route = chatReq.Route
+		} else {
+			reqLog(ctx, "Warning: ignoring invalid route %q", chatReq.Route)
+			openRouterReq.Route = ""
+		}
+	}
+
+	// stream_options is only valid on streaming requests; the final usage
+	// chunk it produces is forwarded untouched by handleStreamingResponse
+	if chatReq.Stream && chatReq.StreamOptions != nil {
+		openRouterReq.StreamOptions = chatReq.StreamOptions
+	}
+
+	// Handle tools/functions
+	if len(chatReq.Tools) > 0 {
+		openRouterReq.Tools = chatReq.Tools
+		if tc := convertToolChoice(chatReq.ToolChoice, model); tc != nil {
+			openRouterReq.ToolChoice = tc
+		}
+	} else if len(chatReq.Functions) > 0 {
+		tools := make([]Tool, len(chatReq.Functions))
+		for i, fn := range chatReq.Functions {
+			tools[i] = Tool{
+				Type:     "function",
+				Function: fn,
+			}
+		}
+		openRouterReq.Tools = tools
+		if tc := convertToolChoice(chatReq.ToolChoice, model); tc != nil {
+			openRouterReq.ToolChoice = tc
+		}
+	}
+
+	// parallel_tool_calls is only meaningful when tools can be called
+	if chatReq.ParallelToolCalls != nil && len(openRouterReq.Tools) > 0 {
+		switch {
+		case bytes.Equal(openRouterReq.ToolChoice, toolChoiceNone):
+			reqDebugLog(ctx, "Ignoring parallel_tool_calls since tool_choice is none")
+		case providerIn(model, ignoreParallelToolCallsProviders):
+			reqDebugLog(ctx, "Omitting parallel_tool_calls, not supported for model %s", model)
+		default:
+			openRouterReq.ParallelToolCalls = chatReq.ParallelToolCalls
+		}
+	}
+
+	return openRouterReq
+}
+
+// sendUpstream forwards openRouterReq to the endpoint of upstream with its
+// API key. The call is bound to the client request context.
+func sendUpstream(r *http.Request, upstream Config, openRouterReq OpenRouterRequest) (*http.Response, error) {
+	// Create new request body
+	modifiedBody, err := json.Marshal(openRouterReq)
+	if err != nil {
+		return nil, fmt.Errorf("creating modified request body: %w", err)
+	}
+
+	reqDebugLog(r.Context(), "Modified request body: %s", string(modifiedBody))
+
+	// Create the proxy request to OpenRouter
+	targetURL := upstream.endpoint
+	if !strings.HasSuffix(targetURL, "/") {
+		targetURL += "/"
+	}
+	targetURL += strings.TrimPrefix(r.URL.Path, "/v1/")
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	proxyReq, err := http.NewRequest(r.Method, targetURL, bytes.NewReader(modifiedBody))
+	if err != nil {
+		return nil, fmt.Errorf("creating proxy request: %w", err)
+	}
+
+	// Set common headers
+	proxyReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", upstream.apiKey))
+	proxyReq.Header.Set("Content-Type", "application/json")
+	proxyReq.Header.Set("Accept", "application/json")
+	proxyReq.Header.Set("User-Agent", upstream.userAgent)
+	proxyReq.Header.Set("HTTP-Referer", upstream.referer)
+	proxyReq.Header.Set("X-Title", upstream.title)
+	proxyReq.Header.Set("OpenAI-Organization", "cursor-proxy")
+	if id := requestIDFrom(r.Context()); id != "" {
+		proxyReq.Header.Set("X-Request-ID", id)
+	}
+
+	// Model-specific headers
+	switch extractProvider(openRouterReq.Model) {
+	case "mistralai":
+		proxyReq.Header.Set("X-Model-Provider", "mistral")
+	case "google":
+		proxyReq.Header.Set("X-Model-Provider", "google")
+	}
+	applyModelHeaders(proxyReq.Header, openRouterReq.Model)
+
+	// Remove problematic headers
+	proxyReq.Header.Del("X-Forwarded-For")
+	proxyReq.Header.Del("X-Forwarded-Host")
+	proxyReq.Header.Del("X-Forwarded-Port")
+	proxyReq.Header.Del("X-Forwarded-Proto")
+	proxyReq.Header.Del("X-Forwarded-Server")
+	proxyReq.Header.Del("X-Real-Ip")
+
+	// Advertise every decoding readResponse supports; streamed bodies, and
+	// large bodies piped by STREAM_LARGE_RESPONSES, are relayed without
+	// decoding so they must stay uncompressed
+	if openRouterReq.Stream {
+		proxyReq.Header.Set("Accept", "text/event-stream")
+		proxyReq.Header.Set("Accept-Encoding", "identity")
+	} else if streamLargeResponses {
+		proxyReq.Header.Set("Accept-Encoding", "identity")
+	} else if !disableUpstreamCompression {
+		proxyReq.Header.Set("Accept-Encoding", "gzip, br, zstd, deflate, identity")
+	}
+	reqDebugLog(r.Context(), "Upstream request headers: %v", maskHeaders(proxyReq.Header))
+
+	// The upstream call gets its own span, and the trace context is
+	// forwarded so OpenRouter-side traces can be correlated
+	ctx, span := tracer.Start(r.Context(), "openrouter.request",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.url", targetURL),
+			attribute.String("http.method", r.Method),
+			attribute.String("model", openRouterReq.Model),
+			attribute.Bool("stream", openRouterReq.Stream),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(proxyReq.Header))
+
+	// Abort the upstream call as soon as the client goes away
+	proxyReq = proxyReq.WithContext(r.Context())
+	resp, err := httpClient.Do(proxyReq)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	}
+	span.End()
+	return resp, err
+}
+
+// sendWithRetries sends the request through the queue, retrying rate
+// limited (429) and 5xx responses up to UPSTREAM_MAX_RETRIES times
+func sendWithRetries(r *http.Request, upstream Config, openRouterReq OpenRouterRequest) (*http.Response, error) {
+	maxRetries := maxRetriesFor(r)
+	for attempt := 0; ; attempt++ {
+		resp, err := queuedSendUpstream(r, upstream, openRouterReq)
+		if err != nil || attempt >= maxRetries || !retryableStatus(resp.StatusCode) {
+			return resp, err
+		}
+		resp.Body.Close()
+
+		delay := retryStrategy.NextDelay(attempt, resp)
+		reqLog(r.Context(), "Upstream returned %d, retrying in %s (attempt %d/%d)", resp.StatusCode, delay, attempt+1, maxRetries)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// maxRetriesFor returns the upstream retries of r: UPSTREAM_MAX_RETRIES, or
+// the 0 to 10 of its X-Proxy-Max-Retries header with ALLOW_RETRY_OVERRIDE.
+// Invalid header values are ignored.
+func maxRetriesFor(r *http.Request) int {
+	value := r.Header.Get("X-Proxy-Max-Retries")
+	if value == "" || !allowRetryOverride {
+		return upstreamMaxRetries
+	}
+	retries, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || retries < 0 || retries > 10 {
+		reqLog(r.Context(), "Warning: ignoring invalid X-Proxy-Max-Retries %q", value)
+		return upstreamMaxRetries
+	}
+	return retries
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// RetryStrategy computes the wait before retrying an upstream response.
+// attempt is 0 for the first retry.
+type RetryStrategy interface {
+	NextDelay(attempt int, resp *http.Response) time.Duration
+}
+
+// ExponentialBackoff doubles the delay after each attempt, up to Max
+type ExponentialBackoff struct {
+	Base, Max time.Duration
+}
+
+func (b ExponentialBackoff) NextDelay(attempt int, resp *http.Response) time.Duration {
+	// Past 30 doublings the shift could overflow, and Max is reached anyway
+	if attempt >= 30 {
+		return b.Max
+	}
+	return capDelay(b.Base<<attempt, b.Max)
+}
+
+// LinearBackoff adds Base to the delay after each attempt, up to Max
+type LinearBackoff struct {
+	Base, Max time.Duration
+}
+
+func (b LinearBackoff) NextDelay(attempt int, resp *http.Response) time.Duration {
+	return capDelay(b.Base*time.Duration(attempt+1), b.Max)
+}
+
+// FixedDelay waits the same time before every attempt
+type FixedDelay struct {
+	Delay time.Duration
+}
+
+func (d FixedDelay) NextDelay(attempt int, resp *http.Response) time.Duration {
+	return d.Delay
+}
+
+func capDelay(delay, max time.Duration) time.Duration {
+	if max > 0 && delay > max {
+		return max
+	}
+	return delay
+}
+
+// retryAfterStrategy honors the Retry-After header of 429 responses, capped
+// at RETRY_AFTER_CAP_SECONDS, and otherwise defers to next
+type retryAfterStrategy struct {
+	next RetryStrategy
+}
+
+func (s retryAfterStrategy) NextDelay(attempt int, resp *http.Response) time.Duration {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return capDelay(delay, retryAfterCap)
+		}
+	}
+	return s.next.NextDelay(attempt, resp)
+}
+
+// newRetryStrategy builds the strategy named by RETRY_STRATEGY
+func newRetryStrategy(name string, base, max time.Duration) (RetryStrategy, error) {
+	switch name {
+	case "", "exponential":
+		return ExponentialBackoff{Base: base, Max: max}, nil
+	case "linear":
+		return LinearBackoff{Base: base, Max: max}, nil
+	case "fixed":
+		return FixedDelay{Delay: base}, nil
+	}
+	return nil, fmt.Errorf("unknown retry strategy %q (use exponential, linear or fixed)", name)
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
+
+// forwardRetryAfter passes the Retry-After header of an upstream 429 on to
+// the client
+func forwardRetryAfter(w http.ResponseWriter, resp *http.Response) {
+	if value := resp.Header.Get("Retry-After"); value != "" && resp.StatusCode == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", value)
+	}
+}
+
+// KEY_REFRESH_URL issues a new OpenRouter key when the active one is
+// rejected, for setups with short-lived keys. It is called at most once per
+// keyRefreshInterval.
+var (
+	keyRefreshURL    string
+	keyRefreshClient = &http.Client{Timeout: 10 * time.Second}
+	keyRefreshMu     sync.Mutex
+	lastKeyRefresh   time.Time
+)
+
+const keyRefreshInterval = time.Minute
+
+// refreshAPIKey returns the key replacing staleKey, the active key OpenRouter
+// rejected. Requests rejected together wait for a single refresh and share
+// its key.
+func refreshAPIKey(ctx context.Context, staleKey string) (string, bool) {
+	keyRefreshMu.Lock()
+	defer keyRefreshMu.Unlock()
+	if key := activeState.Load().config.apiKey; key != staleKey {
+		return key, true
+	}
+	if time.Since(lastKeyRefresh) < keyRefreshInterval {
+		reqDebugLog(ctx, "API key refreshed less than %s ago, not refreshing again", keyRefreshInterval)
+		return "", false
+	}
+	lastKeyRefresh = time.Now()
+
+	key, err := fetchRefreshedKey(ctx, staleKey)
+	if err != nil {
+		reqLog(ctx, "Warning: refreshing the API key failed: %v", err)
+		return "", false
+	}
+	updateActiveState(func(state *configState) { state.config.apiKey = key })
+	recordConfigChange("key_refresh", "key_refresh")
+	log.Printf("Refreshed OpenRouter API key: %s", maskAPIKey(key))
+	return key, true
+}
+
+// fetchRefreshedKey posts the hash of staleKey to KEY_REFRESH_URL, which
+// answers {"api_key": "sk-or-..."}
+func fetchRefreshedKey(ctx context.Context, staleKey string) (string, error) {
+	payload, _ := json.Marshal(map[string]string{"key_hash": hashKey(staleKey)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, keyRefreshURL, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := keyRefreshClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("refresh endpoint returned %d", resp.StatusCode)
+	}
+	var refreshed struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&refreshed); err != nil {
+		return "", fmt.Errorf("parsing refresh response: %w", err)
+	}
+	if refreshed.APIKey == "" {
+		return "", fmt.Errorf("refresh response has no api_key")
+	}
+	return refreshed.APIKey, nil
+}
+
+// pendingRequest is a non-streaming request in flight whose response is
+// shared with identical requests arriving shortly after it
+type pendingRequest struct {
+	started     time.Time
+	done        chan struct{}
+	response    []byte
+	status      int
+	contentType string
+}
+
+var pendingRequests sync.Map
+
+// deduplicationWindow is how long after an identical request started a new
+// one may still share its response
+const deduplicationWindow = 100 * time.Millisecond
+
+// Headers that change the outcome of a request, part of its fingerprint
+var fingerprintHeaders = []string{"Authorization", "X-Fallback-Model", "X-Proxy-Model", "X-Tenant-ID", "X-Session-ID"}
+
+// requestFingerprint hashes the method, path, outcome-changing headers and
+// body of a request
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	for _, name := range fingerprintHeaders {
+		hash.Write([]byte(name + ": " + r.Header.Get(name) + "\n"))
+	}
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// captureWriter writes through to the client while keeping a copy of the
+// response
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+// idempotentResponse is the successful response of a request with an
+// Idempotency-Key, replayed to requests with the same key and body until it
+// expires. A status of 0 marks a request still in flight.
+type idempotentResponse struct {
+	bodyHash    [sha256.Size]byte
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+// idempotencyStore holds the idempotentResponse of each key hash and
+// Idempotency-Key
+var idempotencyStore sync.Map
+
+// storeIdempotentResponse replaces the in-flight marker of key with the
+// response captured for it, kept for IDEMPOTENCY_TTL. Errors are not kept,
+// so they can be retried.
+func storeIdempotentResponse(key string, marker *idempotentResponse, capture *captureWriter) {
+	status := capture.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status >= 300 {
+		if stored, ok := idempotencyStore.Load(key); ok && stored == marker {
+			idempotencyStore.Delete(key)
+		}
+		return
+	}
+	response := &idempotentResponse{
+		bodyHash:    marker.bodyHash,
+		status:      status,
+		contentType: capture.Header().Get("Content-Type"),
+		body:        capture.body.Bytes(),
+		expires:     time.Now().Add(idempotencyTTL),
+	}
+	idempotencyStore.Store(key, response)
+	time.AfterFunc(idempotencyTTL, func() {
+		if stored, ok := idempotencyStore.Load(key); ok && stored == response {
+			idempotencyStore.Delete(key)
+		}
+	})
+}
+
+// queuedSendUpstream runs sendUpstream on a queue worker, ordered by the
+// X-Priority header of the request. The response is handed back to the
+// calling goroutine, which writes it.
+func queuedSendUpstream(r *http.Request, upstream Config, openRouterReq OpenRouterRequest) (*http.Response, error) {
+	if requestQueue == nil {
+		return sendUpstream(r, upstream, openRouterReq)
+	}
+
+	var resp *http.Response
+	var err error
+	queueErr := requestQueue.submit(r.Context(), r.Header.Get("X-Priority"), func() {
+		resp, err = sendUpstream(r, upstream, openRouterReq)
+	})
+	if queueErr != nil {
+		return nil, queueErr
+	}
+	return resp, err
+}
+
+// forwardUpstreamError relays an upstream error response in the OpenAI format
+func forwardUpstreamError(w http.ResponseWriter, status int, respBody []byte) {
+	// Try to parse the error response
+	var openRouterErr struct {
+		Error APIError `json:"error"`
+	}
+
+	if err := json.Unmarshal(respBody, &openRouterErr); err != nil || openRouterErr.Error.Message == "" {
+		// If we can't parse the error, wrap the raw response
+		writeError(w, status, errorTypeForStatus(status), truncateString(string(respBody), 500))
+		return
+	}
+
+	// Return a properly formatted error response
+	apiErr := openRouterErr.Error
+	if apiErr.Type == "" {
+		apiErr.Type = errorTypeForStatus(status)
+	}
+	if apiErr.Code == nil {
+		apiErr.Code = status
+	}
+	writeAPIError(w, status, apiErr)
+}
+
+// isFallbackError reports whether an upstream error is model specific and
+// worth retrying with the X-Fallback-Model
+func isFallbackError(status int, respBody []byte) bool {
+	return status == http.StatusBadRequest ||
+		status == http.StatusRequestEntityTooLarge ||
+		bytes.Contains(respBody, []byte("context_length_exceeded"))
+}
+
+func handleStreamingResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, counter *streamTokenCounter, responseModel string) {
+	reqDebugLog(r.Context(), "Starting streaming response handling")
+	reqDebugLog(r.Context(), "Response status: %d", resp.StatusCode)
+	reqDebugLog(r.Context(), "Response headers: %+v", resp.Header)
+
+	// Set headers for streaming response
+	forwardUpstreamHeaders(w, resp)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Trailer", "X-Proxy-TTFT-Ms, X-OpenRouter-Generation-ID")
+	w.WriteHeader(resp.StatusCode)
+
+	// The upstream connection is established once the response headers are in
+	summary := summaryFrom(r.Context())
+	streamStart := time.Now()
+	activeStreams.Add(1)
+	defer activeStreams.Add(-1)
+	addOTelActiveStreams(r.Context(), 1)
+	defer addOTelActiveStreams(r.Context(), -1)
+	_, span := tracer.Start(r.Context(), "openrouter.stream", trace.WithAttributes(attribute.String("model", summary.model)))
+	defer span.End()
+	defer func() {
+		streamDuration.WithLabelValues(summary.model).Observe(time.Since(streamStart).Seconds())
+		if summary.ttft > 0 {
+			w.Header().Set("X-Proxy-TTFT-Ms", strconv.FormatInt(summary.ttft.Milliseconds(), 10))
+		}
+		if summary.generationID != "" {
+			w.Header().Set("X-OpenRouter-Generation-ID", summary.generationID)
+		}
+	}()
+
+	// Create a buffered reader for the response body
+	reader := bufio.NewReader(resp.Body)
+
+	// Create a context with cancel for cleanup; it is derived from the
+	// request context so a client disconnect also stops the stream
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Closing the body aborts the upstream request and unblocks the reader
+	// goroutine when the stream ends early
+	defer resp.Body.Close()
+
+	// Read upstream lines in a goroutine so the loop below can react to
+	// cancellation while a read is blocked
+	lines := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				readErr <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	// Heartbeats are sent from the same loop so they never interleave with
+	// a chunk being written
+	heartbeat := time.NewTicker(streamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	// A stalled upstream ends the stream, the timer restarts on every line
+	var stalled <-chan time.Time
+	var stallTimer *time.Timer
+	if streamChunkTimeout > 0 {
+		stallTimer = time.NewTimer(streamChunkTimeout)
+		defer stallTimer.Stop()
+		stalled = stallTimer.C
+	}
+
+	// Whether a chunk carried a finish_reason; if none did by [DONE], a
+	// chunk with the default one is sent before it
+	finished := false
+
+	// Tokens are estimated as the spaces of the data lines, compact JSON
+	// having none outside the content
+	streamedTokens, nextProgress := 0, progressIntervalTokens
+
+	invalidChunks := 0
+	for {
+		select {
+		case <-r.Context().Done():
+			reqLog(r.Context(), "Client disconnected, ending stream")
+			return
+		case <-ctx.Done():
+			reqLog(r.Context(), "Context cancelled, ending stream")
+			return
+		case <-heartbeat.C:
+			// Send a heartbeat comment
+			if _, err := w.Write([]byte(": heartbeat\n\n")); err != nil {
+				reqLog(r.Context(), "Error sending heartbeat: %v", err)
+				return
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		case <-stalled:
+			reqLog(r.Context(), "No data from upstream for %s, ending stream", streamChunkTimeout)
+			cancel()
+			chunk := errorBody(http.StatusGatewayTimeout, errTypeServer, "stream timeout")
+			if _, err := w.Write([]byte("data: " + string(chunk) + "\n\n" + doneSentinel)); err != nil {
+				reqLog(r.Context(), "Error writing to response: %v", err)
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			return
+		case line, ok := <-lines:
+			if stallTimer != nil {
+				if !stallTimer.Stop() {
+					<-stallTimer.C
+				}
+				stallTimer.Reset(streamChunkTimeout)
+			}
+			if !ok {
+				err := <-readErr
+				switch {
+				case err == io.EOF:
+					reqDebugLog(r.Context(), "Upstream closed the stream")
+				case errors.Is(err, context.Canceled):
+					reqLog(r.Context(), "Context cancelled, ending stream")
+				default:
+					reqLog(r.Context(), "Error reading stream: %v", err)
+				}
+				return
+			}
+
+			// Skip empty lines
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			if validateSSEJSON && bytes.HasPrefix(line, []byte("data:")) && !isDoneSentinel(line) {
+				payload := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+				if !json.Valid(payload) {
+					invalidSSEChunks.Inc()
+					invalidChunks++
+					reqLog(r.Context(), "Warning: dropping SSE chunk with invalid JSON: %s", truncateString(string(line), 100))
+					if invalidChunks > invalidChunkThreshold {
+						reqLog(r.Context(), "Aborting stream after %d invalid chunks", invalidChunks)
+						chunk := errorBody(http.StatusBadGateway, errTypeServer, "Upstream sent too many malformed stream chunks")
+						if _, err := w.Write([]byte("data: " + string(chunk) + "\n\n" + doneSentinel)); err != nil {
+							reqLog(r.Context(), "Error writing to response: %v", err)
+						}
+						if f, ok := w.(http.Flusher); ok {
+							f.Flush()
+						}
+						return
+					}
+					continue
+				}
+			}
+
+			// An error sent mid-stream is relayed in the non-streaming error
+			// format and ends the stream
+			if bytes.HasPrefix(line, []byte("data:")) && bytes.Contains(line, []byte(`"error"`)) {
+				if apiErr, ok := streamChunkError(line); ok {
+					streamErrors.Inc()
+					span.SetStatus(codes.Error, apiErr.Message)
+					reqLog(r.Context(), "Error: upstream sent an error in the stream: %s", apiErr.Message)
+					chunk, _ := json.Marshal(map[string]APIError{"error": apiErr})
+					if _, err := w.Write([]byte("data: " + string(chunk) + "\n\n" + doneSentinel)); err != nil {
+						reqLog(r.Context(), "Error writing to response: %v", err)
+					}
+					if f, ok := w.(http.Flusher); ok {
+						f.Flush()
+					}
+					return
+				}
+			}
+
+			if bytes.HasPrefix(line, []byte("data:")) {
+				if summary.firstByte() {
+					upstreamLatency.WithLabelValues(summary.model, "true").Observe(summary.upstreamWait.Seconds())
+				}
+				if summary.ttft == 0 {
+					span.AddEvent("first_chunk")
+					summary.ttft = time.Since(streamStart)
+					ttftSeconds.WithLabelValues(summary.model).Observe(summary.ttft.Seconds())
+				}
+				if summary.generationID == "" {
+					summary.generationID = generationIDFrom(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:"))))
+				}
+				if bytes.Contains(line, []byte(`"usage"`)) && recordStreamUsage(summary, line) && counter != nil {
+					counter.upstreamUsage = true
+				}
+				if counter != nil {
+					counter.add(line)
+				}
+				if progressIntervalTokens > 0 {
+					streamedTokens += bytes.Count(bytes.TrimSpace(line[len("data:"):]), []byte(" "))
+				}
+				if !finished && bytes.Contains(line, []byte(`"finish_reason"`)) {
+					finished = hasFinishReason(line)
+				}
+			}
+
+			// Normalize the end-of-stream sentinel and stop reading
+			if isDoneSentinel(line) {
+				if !finished && defaultFinishReason != "" {
+					reqDebugLog(r.Context(), "No finish_reason in the stream, sending %q", defaultFinishReason)
+					if _, err := w.Write(finishChunk(defaultFinishReason)); err != nil {
+						reqLog(r.Context(), "Error writing to response: %v", err)
+						return
+					}
+				}
+				if counter != nil && counter.emitUsage && !counter.upstreamUsage {
+					if chunk := counter.usageChunk(summary); chunk != nil {
+						if _, err := w.Write(chunk); err != nil {
+							reqLog(r.Context(), "Error writing to response: %v", err)
+						}
+					}
+				}
+				if _, err := w.Write([]byte(doneSentinel)); err != nil {
+					reqLog(r.Context(), "Error writing to response: %v", err)
+				}
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+				reqDebugLog(r.Context(), "Stream completed")
+				return
+			}
+
+			if !isValidSSELine(line) {
+				reqLog(r.Context(), "Warning: malformed SSE line from upstream: %s", truncateString(string(line), 100))
+				if strictSSE {
+					continue
+				}
+			}
+
+			if stripReasoning && bytes.HasPrefix(line, []byte("data:")) {
+				line = stripReasoningDelta(line)
+			}
+
+			// Write the line to the response, with the chunk model rewritten
+			// in a pooled buffer
+			var buf *bytes.Buffer
+			if responseModel != "" && bytes.HasPrefix(line, []byte("data:")) && bytes.Contains(line, []byte(`"model"`)) {
+				buf = getBuffer(len(line))
+				line = rewriteChunkModel(buf, line, responseModel)
+			}
+			_, err := w.Write(line)
+			if buf != nil {
+				putBuffer(buf)
+			}
+			if err != nil {
+				reqLog(r.Context(), "Error writing to response: %v", err)
+				return
+			}
+
+			// Report progress as an SSE comment, which clients ignore
+			if progressIntervalTokens > 0 && streamedTokens >= nextProgress {
+				progress := fmt.Sprintf(": progress tokens=%d elapsed_ms=%d\n\n", streamedTokens, time.Since(streamStart).Milliseconds())
+				if _, err := w.Write([]byte(progress)); err != nil {
+					reqLog(r.Context(), "Error writing to response: %v", err)
+					return
+				}
+				nextProgress = (streamedTokens/progressIntervalTokens + 1) * progressIntervalTokens
+			}
+
+			// Flush the response writer
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			} else {
+				reqLog(r.Context(), "Warning: ResponseWriter does not support Flush")
+			}
+		}
+	}
+}
+
+// reasoningFields are the delta fields removed by STRIP_REASONING; OpenRouter
+// names the field reasoning
+var reasoningFields = []string{"thinking", "reasoning_content", "reasoning"}
+
+// stripReasoningDelta removes the reasoning fields from the deltas of an SSE
+// data line. Lines without them are returned unchanged.
+func stripReasoningDelta(line []byte) []byte {
+	if !bytes.Contains(line, []byte(`"thinking"`)) && !bytes.Contains(line, []byte(`"reasoning`)) {
+		return line
+	}
+	var chunk map[string]json.RawMessage
+	if json.Unmarshal(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:"))), &chunk) != nil {
+		return line
+	}
+	var choices []map[string]json.RawMessage
+	if json.Unmarshal(chunk["choices"], &choices) != nil {
+		return line
+	}
+	for _, choice := range choices {
+		var delta map[string]json.RawMessage
+		if json.Unmarshal(choice["delta"], &delta) != nil {
+			continue
+		}
+		for _, field := range reasoningFields {
+			delete(delta, field)
+		}
+		choice["delta"], _ = json.Marshal(delta)
+	}
+	chunk["choices"], _ = json.Marshal(choices)
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return line
+	}
+	return []byte("data: " + string(data) + "\n")
+}
+
+// hasFinishReason reports whether a choice of an SSE data line has a
+// non-null finish_reason
+func hasFinishReason(line []byte) bool {
+	var chunk struct {
+		Choices []struct {
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if json.Unmarshal(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:"))), &chunk) != nil {
+		return false
+	}
+	for _, choice := range chunk.Choices {
+		if choice.FinishReason != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// finishChunk returns an SSE chunk ending the first choice with reason
+func finishChunk(reason string) []byte {
+	chunk, _ := json.Marshal(map[string]interface{}{
+		"choices": []map[string]interface{}{{"index": 0, "delta": map[string]interface{}{}, "finish_reason": reason}},
+	})
+	return []byte("data: " + string(chunk) + "\n\n")
+}
+
+// streamChunkError returns the top-level error of an SSE data line, with
+// the type and code filled in like forwardUpstreamError does
+func streamChunkError(line []byte) (APIError, bool) {
+	var chunk struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if json.Unmarshal(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:"))), &chunk) != nil ||
+		len(chunk.Error) == 0 || bytes.Equal(chunk.Error, []byte("null")) {
+		return APIError{}, false
+	}
+
+	var apiErr APIError
+	if json.Unmarshal(chunk.Error, &apiErr) != nil {
+		// Some providers send the error as a plain string
+		var message string
+		json.Unmarshal(chunk.Error, &message)
+		apiErr = APIError{Message: message}
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = "Upstream error during streaming"
+	}
+	status := http.StatusBadGateway
+	if code, ok := apiErr.Code.(float64); ok && code >= 400 && code < 600 {
+		status = int(code)
+	}
+	if apiErr.Type == "" {
+		apiErr.Type = errorTypeForStatus(status)
+	}
+	if apiErr.Code == nil {
+		apiErr.Code = status
+	}
+	return apiErr, true
+}
+
+// rewriteChunkModel sets the model of the chunk in an SSE data line,
+// encoding the new line into buf. Lines that do not parse are returned
+// unchanged.
+func rewriteChunkModel(buf *bytes.Buffer, line []byte, model string) []byte {
+	var chunk map[string]json.RawMessage
+	if json.Unmarshal(bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:"))), &chunk) != nil {
+		return line
+	}
+	if _, ok := chunk["model"]; !ok {
+		return line
+	}
+	chunk["model"], _ = json.Marshal(model)
+
+	// The encoder ends the line with a newline and, unlike json.Marshal,
+	// leaves < > & in the content unescaped
+	buf.WriteString("data: ")
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if encoder.Encode(chunk) != nil {
+		return line
+	}
+	return buf.Bytes()
+}
+
+// generationIDFrom returns the OpenRouter generation ID of a completion or
+// stream chunk: its openrouter-generation-id field when present, else its id
+func generationIDFrom(data []byte) string {
+	var fields struct {
+		GenerationID string `json:"openrouter-generation-id"`
+		ID           string `json:"id"`
+	}
+	if json.Unmarshal(data, &fields) != nil {
+		return ""
+	}
+	if fields.GenerationID != "" {
+		return fields.GenerationID
+	}
+	return fields.ID
+}
+
+// recordStreamUsage records token counts from an SSE chunk carrying usage
+// and reports whether the chunk had any
+func recordStreamUsage(summary *requestSummary, line []byte) bool {
+	var chunk struct {
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if json.Unmarshal(data, &chunk) != nil || chunk.Usage == nil {
+		return false
+	}
+	summary.recordUsage(chunk.Usage.PromptTokens, chunk.Usage.CompletionTokens)
+	return true
+}
+
+// streamTokenCounter accumulates streamed completion text so token usage can
+// be reported for models that ignore stream_options.include_usage
+type streamTokenCounter struct {
+	messages      []Message
+	model         string
+	completion    strings.Builder
+	upstreamUsage bool
+
+	// Append a usage chunk when the upstream sends none
+	emitUsage bool
+}
+
+// add accumulates the delta.content of an SSE data line
+func (c *streamTokenCounter) add(line []byte) {
+	var chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	data := bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+	if json.Unmarshal(data, &chunk) != nil {
+		return
+	}
+	for _, choice := range chunk.Choices {
+		c.completion.WriteString(choice.Delta.Content)
+	}
+}
+
+// usageChunk counts the prompt and completion tokens, records them on
+// summary and returns them as an SSE usage chunk. It returns nil when no
+// tokenizer is available.
+func (c *streamTokenCounter) usageChunk(summary *requestSummary) []byte {
+	encoding, err := tokenizerForModel(c.model)
+	if err != nil {
+		log.Printf("Warning: token counting skipped, loading tokenizer of %s failed: %v", c.model, err)
+		return nil
+	}
+
+	var prompt strings.Builder
+	for _, message := range c.messages {
+		prompt.WriteString(message.Role)
+		prompt.WriteString("\n")
+		prompt.WriteString(message.Content.String())
+		prompt.WriteString("\n")
+	}
+	promptTokens := len(encoding.Encode(prompt.String(), nil, nil))
+	completionTokens := len(encoding.Encode(c.completion.String(), nil, nil))
+	summary.recordUsage(promptTokens, completionTokens)
+
+	usage, _ := json.Marshal(map[string]interface{}{
+		"usage": map[string]int{
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"total_tokens":      promptTokens + completionTokens,
+		},
+	})
+	return []byte("data: " + string(usage) + "\n\n")
+}
+
+var (
+	tokenizerOnce sync.Once
+	tokenizer     *tiktoken.Tiktoken
+)
+
+// streamTokenizer returns the shared cl100k_base tokenizer, or nil if it
+// could not be loaded
+func streamTokenizer() *tiktoken.Tiktoken {
+	tokenizerOnce.Do(func() {
+		encoding, err := tokenizerForModel("")
+		if err != nil {
+			log.Printf("Warning: token counting disabled, loading tokenizer failed: %v", err)
+			return
+		}
+		tokenizer = encoding
+	})
+	return tokenizer
+}
+
+// providerEncodings maps provider prefixes to the tiktoken encoding closest
+// to their tokenizer. tiktoken only ships OpenAI encodings, so the counts of
+// other providers (Claude, Gemini, Llama...) are approximations.
+var providerEncodings = map[string]string{
+	"openai":    tiktoken.MODEL_O200K_BASE,
+	"anthropic": tiktoken.MODEL_CL100K_BASE,
+	"google":    tiktoken.MODEL_CL100K_BASE,
+	"mistralai": tiktoken.MODEL_CL100K_BASE,
+}
+
+// encodingForModel returns the tiktoken encoding name of model, from the
+// OpenAI model table first, then the provider, defaulting to cl100k_base
+func encodingForModel(model string) string {
+	provider := extractProvider(model)
+	if provider == "openai" {
+		name := strings.TrimPrefix(model, "openai/")
+		if encoding, ok := tiktoken.MODEL_TO_ENCODING[name]; ok {
+			return encoding
+		}
+		for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+			if strings.HasPrefix(name, prefix) {
+				return encoding
+			}
+		}
+	}
+	if encoding, ok := providerEncodings[provider]; ok {
+		return encoding
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = make(map[string]*tiktoken.Tiktoken)
+)
+
+// tokenizerForModel returns the tokenizer matching the tokenizer family of
+// model. Tokenizers are built once per encoding.
+func tokenizerForModel(model string) (*tiktoken.Tiktoken, error) {
+	name := encodingForModel(model)
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	if encoding, ok := tokenizers[name]; ok {
+		return encoding, nil
+	}
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	tokenizers[name] = encoding
+	return encoding, nil
+}
+
+// isDoneSentinel reports whether line matches one of the configured
+// end-of-stream sentinel variants
+func isDoneSentinel(line []byte) bool {
+	trimmed := string(bytes.TrimSpace(line))
+	for _, sentinel := range doneSentinels {
+		if trimmed == sentinel {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidSSELine reports whether line is an SSE comment or a known field
+func isValidSSELine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(":")) ||
+		bytes.HasPrefix(line, []byte("data: ")) ||
+		bytes.HasPrefix(line, []byte("event: ")) ||
+		bytes.HasPrefix(line, []byte("id: "))
+}
+
+// handleRegularResponse relays a non-streaming completion, reporting
+// responseModel (the mocked name Cursor sent) as its model, or the model of
+// the upstream response when responseModel is empty
+func handleRegularResponse(w http.ResponseWriter, resp *http.Response, responseModel string) {
+	reqDebugLog(resp.Request.Context(), "Handling regular (non-streaming) response")
+	reqDebugLog(resp.Request.Context(), "Response status: %d", resp.StatusCode)
+	reqDebugLog(resp.Request.Context(), "Response headers: %+v", resp.Header)
+
+	summary := summaryFrom(resp.Request.Context())
+	upstreamLatency.WithLabelValues(summary.model, "false").Observe(summary.upstreamWait.Seconds())
+
+	forwardUpstreamHeaders(w, resp)
+
+	// Pipe large or unsized uncompressed bodies straight to the client. The
+	// body is not rewritten, so the upstream model name is returned as is.
+	encoding := resp.Header.Get("Content-Encoding")
+	if streamLargeResponses && (encoding == "" || encoding == "identity") &&
+		(resp.ContentLength > largeResponseThreshold || resp.ContentLength < 0) {
+		reqDebugLog(resp.Request.Context(), "Piping large response (%d bytes) without rewriting", resp.ContentLength)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			reqLog(resp.Request.Context(), "Error piping response: %v", err)
+		}
+		return
+	}
+
+	// Read and log response body
+	body, err := readResponse(resp)
+	if err != nil {
+		if !errors.Is(err, io.ErrUnexpectedEOF) || len(body) == 0 {
+			reqDebugLog(resp.Request.Context(), "Error reading response: %v", err)
+			writeError(w, http.StatusInternalServerError, errTypeServer, "Error reading response from upstream")
+			return
+		}
+		reqLog(resp.Request.Context(), "Warning: upstream connection dropped after %d bytes, parsing the partial response", len(body))
+	}
+
+	reqDebugLog(resp.Request.Context(), "Original response body: %s", string(body))
+
+	// Read the generation ID first, the struct below has no field for an
+	// openrouter-generation-id
+	generationID := generationIDFrom(body)
+
+	// Parse the OpenRouter response
+	var openRouterResp struct {
+		ID                string `json:"id"`
+		Object            string `json:"object"`
+		Created           int64  `json:"created"`
+		Model             string `json:"model"`
+		SystemFingerprint string `json:"system_fingerprint,omitempty"`
+		Choices           []struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+		Error *APIError `json:"error,omitempty"`
+	}
+
+	if err := json.Unmarshal(body, &openRouterResp); err != nil {
+		recovered, ok := recoverTruncatedJSON(body, &openRouterResp)
+		if !ok {
+			reqDebugLog(resp.Request.Context(), "Error parsing OpenRouter response: %v", err)
+			reqDebugLog(resp.Request.Context(), "Response body that failed to parse: %s", string(body))
+			writeError(w, http.StatusBadGateway, errTypeServer, fmt.Sprintf("Error parsing response: %v", err))
+			return
+		}
+		reqLog(resp.Request.Context(), "Warning: recovered truncated response by appending %q", recovered)
+		w.Header().Set("X-Proxy-Recovered", "true")
+	}
+
+	summary.recordUsage(openRouterResp.Usage.PromptTokens, openRouterResp.Usage.CompletionTokens)
+
+	// Check for OpenRouter error, relayed with its metadata like
+	// forwardUpstreamError does
+	if apiErr := openRouterResp.Error; apiErr != nil {
+		reqDebugLog(resp.Request.Context(), "OpenRouter returned error: %+v", apiErr)
+		status := http.StatusBadGateway
+		if code, ok := apiErr.Code.(float64); ok && code >= 400 && code < 600 {
+			status = int(code)
+		}
+		if apiErr.Type == "" {
+			apiErr.Type = errorTypeForStatus(status)
+		}
+		if apiErr.Code == nil {
+			apiErr.Code = status
+		}
+		writeAPIError(w, status, *apiErr)
+		return
+	}
+
+	if responseModel == "" {
+		responseModel = openRouterResp.Model
+	}
+	if generationID == "" {
+		generationID = openRouterResp.ID
+	}
+	if generationID != "" {
+		summary.generationID = generationID
+		w.Header().Set("X-OpenRouter-Generation-ID", generationID)
+	}
+
+	// Convert to OpenAI format
+	openAIResp := struct {
+		ID                string `json:"id"`
+		Object            string `json:"object"`
+		Created           int64  `json:"created"`
+		Model             string `json:"model"`
+		SystemFingerprint string `json:"system_fingerprint,omitempty"`
+		Choices           []struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}{
+		ID:                generationID,
+		Object:            "chat.completion",
+		Created:           openRouterResp.Created,
+		Model:             responseModel,
+		SystemFingerprint: openRouterResp.SystemFingerprint,
+		Usage:             openRouterResp.Usage,
+	}
+
+	openAIResp.Choices = make([]struct {
+		Index        int     `json:"index"`
+		Message      Message `json:"message"`
+		FinishReason string  `json:"finish_reason"`
+	}, len(openRouterResp.Choices))
+
+	for i, choice := range openRouterResp.Choices {
+		openAIResp.Choices[i] = struct {
+			Index        int     `json:"index"`
+			Message      Message `json:"message"`
+			FinishReason string  `json:"finish_reason"`
+		}{
+			Index:        choice.Index,
+			Message:      choice.Message,
+			FinishReason: choice.FinishReason,
+		}
+		if stripReasoning {
+			openAIResp.Choices[i].Message.Thinking = ""
+			openAIResp.Choices[i].Message.ReasoningContent = ""
+		}
+
+		// The message already holds the tool calls, drop those without a
+		// function name
+		if len(choice.Message.ToolCalls) > 0 {
+			reqDebugLog(resp.Request.Context(), "Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
+			toolCalls := make([]ToolCall, 0, len(choice.Message.ToolCalls))
+			for j, tc := range choice.Message.ToolCalls {
+				reqDebugLog(resp.Request.Context(), "Tool call %d: %+v", j, tc)
+				if tc.Function.Name == "" {
+					reqDebugLog(resp.Request.Context(), "Warning: Empty function name in tool call %d", j)
+					continue
+				}
+				toolCalls = append(toolCalls, tc)
+			}
+			openAIResp.Choices[i].Message.ToolCalls = toolCalls
+		}
+	}
+
+	modifiedBody, err := json.Marshal(openAIResp)
+	if err != nil {
+		reqDebugLog(resp.Request.Context(), "Error creating modified response: %v", err)
+		writeError(w, http.StatusInternalServerError, errTypeServer, fmt.Sprintf("Error creating response: %v", err))
+		return
+	}
+
+	if len(stripResponseFields) > 0 {
+		if stripped, err := stripFields(modifiedBody, stripResponseFields); err != nil {
+			reqLog(resp.Request.Context(), "Warning: stripping response fields failed: %v", err)
+		} else {
+			modifiedBody = stripped
+		}
+	}
+
+	reqDebugLog(resp.Request.Context(), "Modified response body: %s", string(modifiedBody))
+
+	if resp.StatusCode == http.StatusOK && len(openAIResp.Choices) > 0 {
+		summary.completion = openAIResp.Choices[0].Message.Content.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(modifiedBody)
+	reqDebugLog(resp.Request.Context(), "Modified response sent successfully")
+}
+
+// stripFields removes the given top-level fields from a JSON object
+func stripFields(body []byte, fields []string) ([]byte, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		delete(object, field)
+	}
+	return json.Marshal(object)
+}
+
+// copyHeaders copies the src headers accepted by keep to dst. Hop-by-hop
+// and encoding headers are never copied, nor headers dst already has, so the
+// proxy's own values (e.g. X-Request-ID) win.
+func copyHeaders(dst, src http.Header, keep func(name string) bool) {
+	skipHeaders := map[string]bool{
+		"Content-Length":    true,
+		"Content-Encoding":  true,
+		"Transfer-Encoding": true,
+		"Connection":        true,
+	}
+
+	for k, vv := range src {
+		if skipHeaders[k] || len(dst.Values(k)) > 0 || !keep(k) {
+			continue
+		}
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// forwardedUpstreamHeader reports whether an upstream response header is
+// passed to clients when FORWARD_UPSTREAM_HEADERS is enabled
+func forwardedUpstreamHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return strings.HasPrefix(name, "X-Ratelimit-") ||
+		strings.HasPrefix(name, "X-Openrouter-") ||
+		name == "X-Request-Id" ||
+		name == "Cf-Ray"
+}
+
+// forwardUpstreamHeaders copies the informational headers of resp, such as
+// rate limits, to the client response
+func forwardUpstreamHeaders(w http.ResponseWriter, resp *http.Response) {
+	if forwardUpstreamHeadersEnabled {
+		copyHeaders(w.Header(), resp.Header, forwardedUpstreamHeader)
+	}
+}
+
+// pushModels offers /v1/models to HTTP/2 clients checking health, as they
+// usually request it next. It only pushes a cached model list, so a health
+// check never fetches from OpenRouter. Push is advisory, so a failure is only
+// logged.
+func pushModels(w http.ResponseWriter, r *http.Request) {
+	pusher, ok := w.(http.Pusher)
+	if !ok || cachedModels.get() == nil {
+		return
+	}
+	opts := &http.PushOptions{Header: http.Header{"Accept": []string{"application/json"}}}
+	if err := pusher.Push("/v1/models", opts); err != nil {
+		reqDebugLog(r.Context(), "Push of /v1/models failed: %v", err)
+	}
+}
+
+func handleModelsRequest(w http.ResponseWriter) {
+	debugLog("Handling models request")
+	response := ModelsResponse{
+		Object: "list",
+		Data: []Model{
+			{
+				ID:      cursorMockedModel,
+				Object:  "model",
+				Created: time.Now().Unix(),
+				OwnedBy: "openai",
+			},
+			{
+				ID:      "deepseek-chat",
+				Object:  "model",
+				Created: time.Now().Unix(),
+				OwnedBy: "deepseek",
+			},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+	debugLog("Models response sent successfully")
+}
+
+func readResponse(resp *http.Response) ([]byte, error) {
+	var reader io.Reader = resp.Body
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	debugLog("Response Content-Encoding: %s", contentEncoding)
+
+	switch contentEncoding {
+	case "gzip":
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error creating gzip reader: %v", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+		debugLog("Using gzip decompression")
+	case "br":
+		reader = brotli.NewReader(resp.Body)
+		debugLog("Using brotli decompression")
+	case "zstd":
+		zstdReader, err := zstd.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error creating zstd reader: %v", err)
+		}
+		defer zstdReader.Close()
+		reader = zstdReader
+		debugLog("Using zstd decompression")
+	case "deflate":
+		// Some servers send raw deflate (RFC 1951) without the zlib wrapper,
+		// so keep the compressed bytes around to retry with flate
+		compressed, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading deflate response: %v", err)
+		}
+		zlibReader, err := zlib.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			debugLog("Using raw deflate decompression")
+			flateReader := flate.NewReader(bytes.NewReader(compressed))
+			defer flateReader.Close()
+			reader = flateReader
+		} else {
+			debugLog("Using zlib decompression")
+			defer zlibReader.Close()
+			reader = zlibReader
+		}
+	case "", "identity":
+		debugLog("No compression detected")
+	default:
+		// Returning the encoded bytes would hand garbage to the JSON parser
+		log.Printf("Warning: unsupported response Content-Encoding %q", contentEncoding)
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", contentEncoding)
+	}
+
+	buf := getBuffer(int(resp.ContentLength))
+	defer putBuffer(buf)
+
+	n, err := io.Copy(buf, reader)
+	if err != nil {
+		// The bytes read before a dropped connection are returned with the
+		// error so callers can try to salvage them
+		return append([]byte(nil), buf.Bytes()...), fmt.Errorf("error reading response: %w", err)
+	}
+	debugLog("Read %d bytes from response", n)
+
+	// Copy out of the pooled buffer, which is reused once returned
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// truncationSuffixes close the JSON of a chat completion cut at its most
+// common points: after the choices, after a choice, after the usage object,
+// and inside the message content
+var truncationSuffixes = []string{"}", "}]}", "}}", "\"}}]}", "}}]}"}
+
+// recoverTruncatedJSON tries to complete a body cut before its closing brace
+// and unmarshals it into v. It returns the suffix that made it parse.
+func recoverTruncatedJSON(body []byte, v interface{}) (string, bool) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[len(trimmed)-1] == '}' {
+		return "", false
+	}
+	for _, suffix := range truncationSuffixes {
+		if json.Unmarshal(append(trimmed[:len(trimmed):len(trimmed)], suffix...), v) == nil {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// checkConfigAuth validates the config auth token when one is configured and
+// writes a 401 response otherwise
+func checkConfigAuth(w http.ResponseWriter, r *http.Request) bool {
+	if configAuthToken == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(configAuthToken)) != 1 {
+		log.Printf("Rejected unauthenticated config request from %s", r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, errTypeAuthentication, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// checkUpstreamChange refuses to change the upstream endpoint or API key
+// through an unauthenticated config API, or to send requests to an endpoint
+// other than https: either would let a client have the OpenRouter key sent
+// to a host it controls
+func checkUpstreamChange(w http.ResponseWriter, r *http.Request, endpoint *string) bool {
+	if configAuthToken == "" {
+		log.Printf("Rejected upstream change from %s: CONFIG_AUTH_TOKEN is not set", r.RemoteAddr)
+		writeError(w, http.StatusForbidden, errTypeAuthentication, "Changing the endpoint or API key requires CONFIG_AUTH_TOKEN to be set")
+		return false
+	}
+	if endpoint != nil && !strings.HasPrefix(*endpoint, "https://") {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Endpoint must be an https URL")
+		return false
+	}
+	return true
+}
+
+func handleConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errTypeInvalidRequest, "Method not allowed")
+		return
+	}
+
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	var config struct {
+		Model string `json:"model"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	if config.Model == "" {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Model is required")
+		return
+	}
+	config.Model = resolveAlias(config.Model, modelAliases)
+
+	if !checkCatalogModel(w, config.Model) {
+		return
+	}
+
+	updateActiveState(func(state *configState) {
+		state.config.model = config.Model
+		state.name = "custom"
+		state.selector = nil
+	})
+	recordConfigChange("config_update", auditRemoteAddr(r.RemoteAddr))
+	log.Printf("Updated model to: %s", config.Model)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"model":  config.Model,
+	})
+}
+
+// checkCatalogModel validates model against the OpenRouter catalog when
+// VALIDATE_MODEL_ON_CONFIG is enabled and writes the error response otherwise
+func checkCatalogModel(w http.ResponseWriter, model string) bool {
+	if !validateModelOnConfig {
+		return true
+	}
+
+	found, err := modelInCatalog(model)
+	if err != nil {
+		log.Printf("Error validating model %s: %v", model, err)
+		writeError(w, http.StatusBadGateway, errTypeServer, "Error validating model")
+		return false
+	}
+	if !found {
+		log.Printf("Rejected unknown model: %s", model)
+		writeError(w, http.StatusUnprocessableEntity, errTypeInvalidRequest, "model not found in OpenRouter catalog")
+		return false
+	}
+	return true
+}
+
+// handlePatchConfigRequest updates only the config fields present in the body
+func handlePatchConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		writeError(w, http.StatusMethodNotAllowed, errTypeInvalidRequest, "Method not allowed")
+		return
+	}
+
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	var patch struct {
+		Model    *string `json:"model"`
+		Endpoint *string `json:"endpoint"`
+		APIKey   *string `json:"api_key"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&patch); err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	// Validate every field before applying any of them
+	if (patch.Endpoint != nil || patch.APIKey != nil) && !checkUpstreamChange(w, r, patch.Endpoint) {
+		return
+	}
+	if patch.Model != nil {
+		*patch.Model = resolveAlias(*patch.Model, modelAliases)
+		if !strings.Contains(*patch.Model, "/") {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Model must contain a provider prefix (e.g. openai/gpt-4o)")
+			return
+		}
+		if !checkCatalogModel(w, *patch.Model) {
+			return
+		}
+	}
+	if patch.APIKey != nil {
+		if !strings.HasPrefix(*patch.APIKey, "sk-or-") || len(*patch.APIKey) < 32 {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "API key must be a valid OpenRouter key (sk-or-...)")
+			return
+		}
+	}
+
+	state := updateActiveState(func(state *configState) {
+		if patch.Model != nil {
+			state.config.model = *patch.Model
+			state.selector = nil
+		}
+		if patch.Endpoint != nil {
+			state.config.endpoint = strings.TrimSuffix(*patch.Endpoint, "/")
+		}
+		if patch.APIKey != nil {
+			state.config.apiKey = *patch.APIKey
+		}
+		state.name = "custom"
+	})
+	recordConfigChange("config_patch", auditRemoteAddr(r.RemoteAddr))
+	log.Printf("Patched config - model: %s, endpoint: %s, key: %s", state.config.model, state.config.endpoint, maskAPIKey(state.config.apiKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"model":    state.config.model,
+		"endpoint": state.config.endpoint,
+		"api_key":  maskAPIKey(state.config.apiKey),
+	})
+}
+
+// ConfigExport is the JSON form of Config used by /v1/config/export and
+// /v1/config/import. The exported API key is always masked.
+type ConfigExport struct {
+	Endpoint  string `json:"endpoint"`
+	Model     string `json:"model"`
+	APIKey    string `json:"api_key"`
+	UserAgent string `json:"user_agent"`
+}
+
+// handleExportConfigRequest returns the active config for backup or copying
+// to another instance
+func handleExportConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+	summaryFrom(r.Context()).action = "config_export"
+
+	config := activeState.Load().config
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ConfigExport{
+		Endpoint:  config.endpoint,
+		Model:     config.model,
+		APIKey:    "***",
+		UserAgent: config.userAgent,
+	})
+}
+
+// handleImportConfigRequest replaces the active config with an exported one.
+// The whole config is validated before it is applied.
+func handleImportConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+	summaryFrom(r.Context()).action = "config_import"
+
+	var imported ConfigExport
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&imported); err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	// An exported config carries the masked key; importing it as is would
+	// replace the real key with the placeholder
+	if imported.APIKey == "***" {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "api_key is masked, set the real OpenRouter key before importing")
+		return
+	}
+	if !strings.HasPrefix(imported.APIKey, "sk-or-") || len(imported.APIKey) < 32 {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "API key must be a valid OpenRouter key (sk-or-...)")
+		return
+	}
+	imported.Model = resolveAlias(imported.Model, modelAliases)
+	if !strings.Contains(imported.Model, "/") {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Model must contain a provider prefix (e.g. openai/gpt-4o)")
+		return
+	}
+	if !checkUpstreamChange(w, r, &imported.Endpoint) {
+		return
+	}
+	if imported.UserAgent == "" {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "user_agent is required")
+		return
+	}
+	if !checkCatalogModel(w, imported.Model) {
+		return
+	}
+
+	state := updateActiveState(func(state *configState) {
+		state.config = Config{
+			endpoint:  strings.TrimSuffix(imported.Endpoint, "/"),
+			model:     imported.Model,
+			apiKey:    imported.APIKey,
+			userAgent: imported.UserAgent,
+			referer:   state.config.referer,
+			title:     state.config.title,
+		}
+		state.name = "custom"
+		state.selector = nil
+	})
+	recordConfigChange("config_import", auditRemoteAddr(r.RemoteAddr))
+	log.Printf("Imported config - model: %s, endpoint: %s, key: %s", state.config.model, state.config.endpoint, maskAPIKey(state.config.apiKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "success",
+		"model":  state.config.model,
+	})
+}
+
+// modelInCatalog reports whether model is listed by OpenRouter's /models
+// endpoint. The list is cached for modelListCacheTTL.
+func modelInCatalog(model string) (bool, error) {
+	modelCatalog.Lock()
+	defer modelCatalog.Unlock()
+
+	if modelCatalog.ids == nil || time.Now().After(modelCatalog.expiry) {
+		ids, err := fetchModelIDs()
+		if err != nil {
+			return false, err
+		}
+		modelCatalog.ids = ids
+		modelCatalog.expiry = time.Now().Add(modelListCacheTTL)
+		debugLog("Cached %d OpenRouter model IDs", len(ids))
+	}
+
+	return modelCatalog.ids[model], nil
+}
+
+// fetchModelIDs retrieves the set of model IDs available on the endpoint of
+// the active config, with its API key
+func fetchModelIDs() (map[string]bool, error) {
+	config := activeState.Load().config
+	req, err := http.NewRequest(http.MethodGet, config.endpoint+"/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.apiKey))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching models: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OpenRouter returned %d", resp.StatusCode)
+	}
+
+	body, err := readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var models ModelsResponse
+	if err := json.Unmarshal(body, &models); err != nil {
+		return nil, fmt.Errorf("error parsing models: %v", err)
+	}
+
+	ids := make(map[string]bool, len(models.Data))
+	for _, m := range models.Data {
+		ids[m.ID] = true
+	}
+	return ids, nil
+}
+
+func handleGetConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errTypeInvalidRequest, "Method not allowed")
+		return
+	}
+
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	state := activeState.Load()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"model":       state.config.model,
+		"active_name": state.name,
+	})
+}
+
+// handleListConfigsRequest returns the named configs of proxy.yaml with
+// their keys masked
+func handleListConfigsRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	configs := make(map[string]NamedConfig, len(namedConfigs))
+	for name, named := range namedConfigs {
+		configs[name] = NamedConfig{
+			Model:          named.config.model,
+			FallbackModels: named.fallbackModels,
+			Endpoint:       named.config.endpoint,
+			APIKey:         maskAPIKey(named.config.apiKey),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active_name": activeState.Load().name,
+		"configs":     configs,
+	})
+}
+
+// handleActivateConfigRequest replaces the active config with a named one
+func handleActivateConfigRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Invalid request body")
+		return
+	}
+	named, ok := namedConfigs[body.Name]
+	if !ok {
+		writeError(w, http.StatusNotFound, errTypeInvalidRequest, fmt.Sprintf("Unknown named config: %q", body.Name))
+		return
+	}
+
+	updateActiveState(func(state *configState) {
+		state.config = named.config
+		state.fallbackModels = named.fallbackModels
+		state.name = body.Name
+		state.selector = nil
+	})
+	recordConfigChange("config_activate", auditRemoteAddr(r.RemoteAddr))
+	log.Printf("Activated config %s - model: %s, endpoint: %s, key: %s", body.Name, named.config.model, named.config.endpoint, maskAPIKey(named.config.apiKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "success",
+		"active_name": body.Name,
+		"model":       named.config.model,
+	})
+}
+
+// ConfigHistoryEntry records a change of the active config, served by
+// /v1/config/history
+type ConfigHistoryEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Model     string    `json:"model"`
+	// Client address of HTTP changes (hashed with AUDIT_HASH_IP), or env,
+	// sighup or key_refresh
+	ChangedBy string `json:"changed_by"`
+	Source    string `json:"source"`
+}
+
+var (
+	configHistoryMu sync.Mutex
+	configHistory   []ConfigHistoryEntry
+
+	// Entries kept in the history (CONFIG_HISTORY_SIZE)
+	configHistorySize = 50
+)
+
+// recordConfigChange adds the active model to the config history, dropping
+// the oldest entries beyond CONFIG_HISTORY_SIZE
+func recordConfigChange(source, changedBy string) {
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
+	configHistory = append(configHistory, ConfigHistoryEntry{
+		Timestamp: time.Now().UTC(),
+		Model:     activeState.Load().config.model,
+		ChangedBy: changedBy,
+		Source:    source,
+	})
+	if excess := len(configHistory) - configHistorySize; excess > 0 {
+		configHistory = append([]ConfigHistoryEntry(nil), configHistory[excess:]...)
+	}
+}
+
+// handleGetConfigHistoryRequest returns the config history, oldest first
+func handleGetConfigHistoryRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+
+	configHistoryMu.Lock()
+	history := append([]ConfigHistoryEntry{}, configHistory...)
+	configHistoryMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"history": history})
+}
+
+// handleOpenAPIRequest serves the embedded OpenAPI spec converted to JSON
+func handleOpenAPIRequest(w http.ResponseWriter) {
+	var spec map[string]interface{}
+	if err := yaml.Unmarshal(openAPISpec, &spec); err != nil {
+		log.Printf("Error parsing OpenAPI spec: %v", err)
+		writeError(w, http.StatusInternalServerError, errTypeServer, "Error parsing OpenAPI spec")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(spec); err != nil {
+		log.Printf("Error encoding OpenAPI spec: %v", err)
+	}
+}
+
+// cachedHealth holds the last health check result so probes do not hit
+// OpenRouter on every call
+type cachedHealth struct {
+	mu     sync.Mutex
+	result bool
+	status int
+	body   []byte
+	expiry time.Time
+}
+
+var health cachedHealth
+
+func (c *cachedHealth) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expiry = time.Time{}
+}
+
+// configInitialized reports whether the active config has been loaded
+func configInitialized() bool {
+	// MOCK_MODE runs without an OpenRouter key
+	state := activeState.Load()
+	return state != nil && (state.config.apiKey != "" || mockMode) && state.config.model != ""
+}
+
+// handleLivenessRequest answers the liveness probe without any upstream call
+func handleLivenessRequest(w http.ResponseWriter) {
+	if !configInitialized() {
+		writeError(w, http.StatusServiceUnavailable, errTypeServer, "Configuration not initialized")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
 
-			// Skip empty lines
-			if len(bytes.TrimSpace(line)) == 0 {
-				continue
-			}
+// handleReadinessRequest answers the readiness probe by checking the
+// OpenRouter connection, unless DISABLE_READINESS_CHECK is set
+func handleReadinessRequest(w http.ResponseWriter) {
+	if !configInitialized() {
+		writeError(w, http.StatusServiceUnavailable, errTypeServer, "Configuration not initialized")
+		return
+	}
+	if os.Getenv("DISABLE_READINESS_CHECK") == "true" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+		return
+	}
 
-			// Write the line to the response
-			if _, err := w.Write(line); err != nil {
-				log.Printf("Error writing to response: %v", err)
-				cancel()
-				return
-			}
+	health.mu.Lock()
+	defer health.mu.Unlock()
 
-			// Flush the response writer
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				log.Printf("Warning: ResponseWriter does not support Flush")
-			}
-		}
+	if time.Now().After(health.expiry) {
+		health.result, health.status, health.body = checkUpstreamHealth()
+		health.expiry = time.Now().Add(time.Duration(envInt("HEALTH_CACHE_TTL", 10)) * time.Second)
+	} else {
+		debugLog("Serving cached health check result (ok: %t)", health.result)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(health.status)
+	w.Write(health.body)
 }
 
-func handleRegularResponse(w http.ResponseWriter, resp *http.Response) {
-	debugLog("Handling regular (non-streaming) response")
-	debugLog("Response status: %d", resp.StatusCode)
-	debugLog("Response headers: %+v", resp.Header)
+// checkUpstreamHealth tests the OpenRouter connection and returns the
+// outcome with the status and JSON body to send to the client
+func checkUpstreamHealth() (bool, int, []byte) {
+	config := activeState.Load().config
+	req, err := http.NewRequest("GET", config.endpoint+"/models", nil)
+	if err != nil {
+		log.Printf("Error creating health check request: %v", err)
+		return false, http.StatusInternalServerError, errorBody(http.StatusInternalServerError, errTypeServer, "Error creating request")
+	}
 
-	// Read and log response body
-	body, err := readResponse(resp)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.apiKey))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("HTTP-Referer", config.referer)
+	req.Header.Set("X-Title", config.title)
+	req.Header.Set("OpenAI-Organization", "cursor-proxy")
+	debugLog("Health check request headers: %v", maskHeaders(req.Header))
+
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		debugLog("Error reading response: %v", err)
-		http.Error(w, "Error reading response from upstream", http.StatusInternalServerError)
-		return
+		log.Printf("Health check failed: %v", err)
+		return false, http.StatusServiceUnavailable, errorBody(http.StatusServiceUnavailable, errTypeServer, "Connection failed")
 	}
+	defer resp.Body.Close()
 
-	debugLog("Original response body: %s", string(body))
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("Health check failed with status %d: %s", resp.StatusCode, string(body))
+		return false, resp.StatusCode, errorBody(resp.StatusCode, errorTypeForStatus(resp.StatusCode), fmt.Sprintf("OpenRouter returned %d", resp.StatusCode))
+	}
 
-	// Parse the OpenRouter response
-	var openRouterResp struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-		Error *struct {
-			Message string `json:"message"`
-			Type    string `json:"type"`
-			Code    int    `json:"code"`
-		} `json:"error,omitempty"`
+	body, _ := json.Marshal(map[string]interface{}{
+		"status":    "ok",
+		"endpoint":  config.endpoint,
+		"providers": providerHealthReport(),
+	})
+	return true, http.StatusOK, body
+}
+
+// reachableModels lists the models the current configuration can route to
+func reachableModels() []string {
+	state := activeState.Load()
+	models := []string{state.config.model}
+	models = append(models, state.fallbackModels...)
+	if selector := state.selector; selector != nil {
+		models = append(models, selector.models...)
 	}
+	for _, rule := range routingRules {
+		models = append(models, rule.model)
+	}
+	return models
+}
 
-	if err := json.Unmarshal(body, &openRouterResp); err != nil {
-		debugLog("Error parsing OpenRouter response: %v", err)
-		debugLog("Response body that failed to parse: %s", string(body))
-		http.Error(w, fmt.Sprintf("Error parsing response: %v", err), http.StatusInternalServerError)
-		return
+func handleGetCapabilitiesRequest(w http.ResponseWriter) {
+	result := make(map[string]ModelCapabilities)
+	for _, model := range reachableModels() {
+		if capabilities, ok := capabilitiesFor(model); ok {
+			result[model] = capabilities
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
 
-	// Check for OpenRouter error
-	if openRouterResp.Error != nil {
-		debugLog("OpenRouter returned error: %+v", openRouterResp.Error)
-		http.Error(w, openRouterResp.Error.Message, openRouterResp.Error.Code)
+func handleGetStatsRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
 		return
 	}
 
-	// Convert to OpenAI format
-	openAIResp := struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		Model   string `json:"model"`
-		Choices []struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		} `json:"choices"`
-		Usage struct {
-			PromptTokens     int `json:"prompt_tokens"`
-			CompletionTokens int `json:"completion_tokens"`
-			TotalTokens      int `json:"total_tokens"`
-		} `json:"usage"`
-	}{
-		ID:      openRouterResp.ID,
-		Object:  "chat.completion",
-		Created: openRouterResp.Created,
-		Model:   cursorMockedModel,
-		Usage:   openRouterResp.Usage,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats.snapshot(r.URL.Query().Get("model")))
+}
+
+// handleGetLatencyRequest returns the upstream latency percentiles of each
+// model over its window. Latencies are not sensitive, so no auth is needed.
+func handleGetLatencyRequest(w http.ResponseWriter) {
+	models := make(map[string]LatencyStats)
+	latencyWindowsMu.Lock()
+	for model, window := range latencyWindows {
+		models[model] = window.stats()
 	}
+	latencyWindowsMu.Unlock()
 
-	openAIResp.Choices = make([]struct {
-		Index        int     `json:"index"`
-		Message      Message `json:"message"`
-		FinishReason string  `json:"finish_reason"`
-	}, len(openRouterResp.Choices))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"as_of":  time.Now().UTC().Format(time.RFC3339),
+		"models": models,
+	})
+}
 
-	for i, choice := range openRouterResp.Choices {
-		openAIResp.Choices[i] = struct {
-			Index        int     `json:"index"`
-			Message      Message `json:"message"`
-			FinishReason string  `json:"finish_reason"`
-		}{
-			Index:        choice.Index,
-			Message:      choice.Message,
-			FinishReason: choice.FinishReason,
-		}
+func handleGetProvidersRequest(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"as_of":     time.Now().UTC().Format(time.RFC3339),
+		"providers": providerStatuses(),
+	})
+}
 
-		if len(choice.Message.ToolCalls) > 0 {
-			debugLog("Processing %d tool calls in choice %d", len(choice.Message.ToolCalls), i)
-			for j, tc := range choice.Message.ToolCalls {
-				debugLog("Tool call %d: %+v", j, tc)
-				if tc.Function.Name == "" {
-					debugLog("Warning: Empty function name in tool call %d", j)
-					continue
-				}
-				openAIResp.Choices[i].Message.ToolCalls = append(openAIResp.Choices[i].Message.ToolCalls, tc)
-			}
-		}
+// benchmarkRequest is the body of POST /v1/benchmark
+type benchmarkRequest struct {
+	Models  []string `json:"models"`
+	Prompt  string   `json:"prompt"`
+	Samples int      `json:"samples"`
+}
+
+// BenchmarkResult holds the latency of one benchmarked model, averaged over
+// its successful samples
+type BenchmarkResult struct {
+	Model      string  `json:"model"`
+	AvgTTFTMs  int64   `json:"avg_ttft_ms"`
+	AvgTotalMs int64   `json:"avg_total_ms"`
+	ErrorRate  float64 `json:"error_rate"`
+}
+
+// Limits keeping a single benchmark from flooding the upstream
+const (
+	maxBenchmarkModels  = 10
+	maxBenchmarkSamples = 10
+)
+
+func handleBenchmarkRequest(w http.ResponseWriter, r *http.Request) {
+	if !checkConfigAuth(w, r) {
+		return
+	}
+	if !enableBenchmark {
+		writeError(w, http.StatusForbidden, errTypeInvalidRequest, "Benchmarking is disabled, set ENABLE_BENCHMARK=true")
+		return
 	}
 
-	modifiedBody, err := json.Marshal(openAIResp)
-	if err != nil {
-		debugLog("Error creating modified response: %v", err)
-		http.Error(w, fmt.Sprintf("Error creating response: %v", err), http.StatusInternalServerError)
+	var req benchmarkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, "Invalid request body")
+		return
+	}
+	if req.Samples <= 0 {
+		req.Samples = 1
+	}
+	if len(req.Models) == 0 || len(req.Models) > maxBenchmarkModels || req.Samples > maxBenchmarkSamples {
+		writeError(w, http.StatusBadRequest, errTypeInvalidRequest, fmt.Sprintf("Benchmark 1 to %d models with at most %d samples", maxBenchmarkModels, maxBenchmarkSamples))
 		return
 	}
+	if req.Prompt == "" {
+		req.Prompt = "hello"
+	}
+	for i, model := range req.Models {
+		req.Models[i] = resolveAlias(model, modelAliases)
+		if !strings.Contains(req.Models[i], "/") {
+			writeError(w, http.StatusBadRequest, errTypeInvalidRequest, fmt.Sprintf("Invalid model %s: must contain a provider prefix", model))
+			return
+		}
+	}
 
-	debugLog("Modified response body: %s", string(modifiedBody))
+	results := make([]BenchmarkResult, len(req.Models))
+	var wg sync.WaitGroup
+	for i, model := range req.Models {
+		wg.Add(1)
+		go func(i int, model string) {
+			defer wg.Done()
+			results[i] = benchmarkModel(r, model, req.Prompt, req.Samples)
+		}(i, model)
+	}
+	wg.Wait()
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(resp.StatusCode)
-	w.Write(modifiedBody)
-	debugLog("Modified response sent successfully")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
 }
 
-func copyHeaders(dst, src http.Header) {
-	skipHeaders := map[string]bool{
-		"Content-Length":    true,
-		"Content-Encoding":  true,
-		"Transfer-Encoding": true,
-		"Connection":        true,
+// benchmarkModel sends prompt to model samples times concurrently. Time to
+// first token is the wait for the response headers, as samples do not stream.
+func benchmarkModel(r *http.Request, model, prompt string, samples int) BenchmarkResult {
+	type sample struct {
+		ttft, total time.Duration
+		err         error
 	}
+	timings := make([]sample, samples)
+	var wg sync.WaitGroup
+	for i := 0; i < samples; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(r.Context(), benchmarkTimeout)
+			defer cancel()
+			sampleReq, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", nil)
+			chatReq := ChatRequest{Model: model, Messages: []Message{{Role: "user", Content: ContentField{Text: prompt}}}}
 
-	for k, vv := range src {
-		if !skipHeaders[k] {
-			for _, v := range vv {
-				dst.Add(k, v)
+			start := time.Now()
+			resp, err := sendUpstream(sampleReq, activeState.Load().config, buildOpenRouterRequest(ctx, chatReq, model))
+			if err != nil {
+				timings[i].err = err
+				return
+			}
+			defer resp.Body.Close()
+			timings[i].ttft = time.Since(start)
+			_, err = io.Copy(io.Discard, resp.Body)
+			if err == nil && resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", resp.StatusCode)
 			}
+			timings[i].total = time.Since(start)
+			timings[i].err = err
+		}(i)
+	}
+	wg.Wait()
+
+	result := BenchmarkResult{Model: model}
+	var ttft, total time.Duration
+	var succeeded int64
+	for _, t := range timings {
+		if t.err != nil {
+			reqDebugLog(r.Context(), "Benchmark sample of %s failed: %v", model, t.err)
+			continue
 		}
+		ttft += t.ttft
+		total += t.total
+		succeeded++
 	}
+	if succeeded > 0 {
+		result.AvgTTFTMs = ttft.Milliseconds() / succeeded
+		result.AvgTotalMs = total.Milliseconds() / succeeded
+	}
+	result.ErrorRate = float64(int64(samples)-succeeded) / float64(samples)
+	return result
 }
 
-func handleModelsRequest(w http.ResponseWriter) {
-	debugLog("Handling models request")
-	response := ModelsResponse{
-		Object: "list",
-		Data: []Model{
-			{
-				ID:      "gpt-4o",
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "openai",
-			},
-			{
-				ID:      "deepseek-chat",
-				Object:  "model",
-				Created: time.Now().Unix(),
-				OwnedBy: "deepseek",
-			},
-		},
-	}
+// latencyAlpha is the weight of the newest probe in the latency EWMA
+const latencyAlpha = 0.3
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-	debugLog("Models response sent successfully")
+// latencyTracker keeps the exponentially weighted moving average of the
+// time to first token of the LATENCY_ROUTING_MODELS, measured by periodic
+// probes, and routes requests to the fastest one
+type latencyTracker struct {
+	mu          sync.RWMutex
+	models      []string
+	ewmaLatency map[string]float64 // milliseconds
 }
 
-func readResponse(resp *http.Response) ([]byte, error) {
-	var reader io.Reader = resp.Body
-	contentEncoding := resp.Header.Get("Content-Encoding")
-	log.Printf("Response Content-Encoding: %s", contentEncoding)
+// latencyRouter is nil unless LATENCY_ROUTING_MODELS is set
+var latencyRouter *latencyTracker
 
-	switch contentEncoding {
-	case "gzip":
-		gzipReader, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("error creating gzip reader: %v", err)
-		}
-		defer gzipReader.Close()
-		reader = gzipReader
-		log.Printf("Using gzip decompression")
-	case "br":
-		reader = brotli.NewReader(resp.Body)
-		log.Printf("Using brotli decompression")
-	default:
-		log.Printf("No compression detected")
-	}
+func newLatencyTracker(models []string) *latencyTracker {
+	return &latencyTracker{models: models, ewmaLatency: make(map[string]float64)}
+}
 
-	buf := getBuffer(int(resp.ContentLength))
-	defer putBuffer(buf)
+// observe adds a probe result to the average of model
+func (l *latencyTracker) observe(model string, ttft time.Duration) {
+	ms := float64(ttft) / float64(time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if previous, ok := l.ewmaLatency[model]; ok {
+		ms = latencyAlpha*ms + (1-latencyAlpha)*previous
+	}
+	l.ewmaLatency[model] = ms
+}
 
-	n, err := io.Copy(buf, reader)
-	if err != nil {
-		return nil, fmt.Errorf("error reading response: %v", err)
+// fastest returns the model with the lowest average latency, or an empty
+// string before any probe succeeded or when l is nil
+func (l *latencyTracker) fastest() string {
+	if l == nil {
+		return ""
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	best := ""
+	for _, model := range l.models {
+		latency, ok := l.ewmaLatency[model]
+		if ok && (best == "" || latency < l.ewmaLatency[best]) {
+			best = model
+		}
 	}
-	log.Printf("Read %d bytes from response", n)
+	return best
+}
 
-	return buf.Bytes(), nil
+// latency returns the average latency of model in milliseconds
+func (l *latencyTracker) latency(model string) (float64, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	latency, ok := l.ewmaLatency[model]
+	return latency, ok
 }
 
-func handleConfigRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// probe sends a one-token streaming request to every model and records the
+// time until the first chunk arrives
+func (l *latencyTracker) probe() {
+	var wg sync.WaitGroup
+	for _, model := range l.models {
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			ttft, err := probeModel(model)
+			if err != nil {
+				log.Printf("Warning: latency probe of %s failed: %v", model, err)
+				return
+			}
+			l.observe(model, ttft)
+			latency, _ := l.latency(model)
+			log.Printf("Latency probe of %s: %dms (average %.0fms)", model, ttft.Milliseconds(), latency)
+		}(model)
 	}
+	wg.Wait()
+}
 
-	var config struct {
-		Model string `json:"model"`
+// probeModel measures the time to first token of a minimal request to model
+func probeModel(model string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	probeReq, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/chat/completions", nil)
+	maxTokens := 1
+	chatReq := ChatRequest{
+		Model:     model,
+		Messages:  []Message{{Role: "user", Content: ContentField{Text: "hi"}}},
+		Stream:    true,
+		MaxTokens: &maxTokens,
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	start := time.Now()
+	resp, err := sendUpstream(probeReq, activeState.Load().config, buildOpenRouterRequest(ctx, chatReq, model))
+	if err != nil {
+		return 0, err
 	}
-
-	if config.Model == "" {
-		http.Error(w, "Model is required", http.StatusBadRequest)
-		return
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
 	}
+	if _, err := resp.Body.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
 
-	activeConfig.model = config.Model
-	log.Printf("Updated model to: %s", activeConfig.model)
+// probeLatencyPeriodically probes the latency routing models now and every
+// interval
+func (l *latencyTracker) probeLatencyPeriodically(interval time.Duration) {
+	go func() {
+		l.probe()
+		for range time.Tick(interval) {
+			l.probe()
+		}
+	}()
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "success",
-		"model":  activeConfig.model,
-	})
+// modelsCache holds the raw /models response from OpenRouter with the
+// validators used to revalidate it
+type modelsCache struct {
+	data         []byte
+	etag         string
+	lastModified string
+	expiry       time.Time
+	mu           sync.RWMutex
 }
 
-func handleGetConfigRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+var cachedModels modelsCache
+
+// get returns the cached body, or nil when it is missing or expired
+func (c *modelsCache) get() []byte {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.data == nil || time.Now().After(c.expiry) {
+		return nil
 	}
+	return c.data
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"model": activeConfig.model,
-	})
+// validators returns the cached body, expired or not, with its ETag and
+// Last-Modified values
+func (c *modelsCache) validators() ([]byte, string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.data, c.etag, c.lastModified
 }
 
-func handleGetModelsRequest(w http.ResponseWriter) {
+func (c *modelsCache) set(data []byte, etag, lastModified string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = data
+	c.etag = etag
+	c.lastModified = lastModified
+	c.expiry = time.Now().Add(time.Duration(envInt("MODELS_CACHE_TTL", 300)) * time.Second)
+}
+
+func (c *modelsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = nil
+	c.etag = ""
+	c.lastModified = ""
+}
+
+// refreshModels fetches the model list from the endpoint of the active
+// config and caches it, revalidating the cached copy when there is one. The
+// returned status is http.StatusNotModified when the cached copy is still
+// current, and is otherwise meaningful only when err is not nil.
+func refreshModels() ([]byte, int, error) {
+	config := activeState.Load().config
 	// Manually create the request for the models endpoint for future header customization
-	req, err := http.NewRequest(http.MethodGet, openRouterEndpoint+"/models", nil)
+	req, err := http.NewRequest(http.MethodGet, config.endpoint+"/models", nil)
 	if err != nil {
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("creating request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.apiKey))
+	cached, etag, lastModified := cachedModels.validators()
+	if cached != nil {
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
 
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		http.Error(w, "Error fetching models", http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("fetching models: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		cachedModels.set(cached, etag, lastModified)
+		return cached, http.StatusNotModified, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to fetch models", resp.StatusCode)
-		return
+		return nil, resp.StatusCode, fmt.Errorf("OpenRouter returned %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("reading models: %w", err)
+	}
+	cachedModels.set(body, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified"))
+	if err := updateDiscoveredCapabilities(body); err != nil {
+		log.Printf("Warning: parsing model capabilities failed: %v", err)
 	}
+	return body, http.StatusOK, nil
+}
 
+func handleGetModelsRequest(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
-	io.Copy(w, resp.Body)
+	cacheStatus := "HIT"
+	body := cachedModels.get()
+	if body == nil {
+		var status int
+		var err error
+		body, status, err = refreshModels()
+		if err != nil {
+			log.Printf("Error fetching models: %v", err)
+			writeError(w, status, errorTypeForStatus(status), "Failed to fetch models")
+			return
+		}
+		// A revalidated copy is still served from the cache, always as a 200
+		if status != http.StatusNotModified {
+			cacheStatus = "MISS"
+		}
+	}
+
+	_, etag, lastModified := cachedModels.validators()
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+	w.Header().Set("X-Proxy-Cache", cacheStatus)
+	if enrichModels {
+		enriched, err := enrichModelList(body)
+		if err != nil {
+			log.Printf("Warning: enriching model list failed: %v", err)
+		} else {
+			body = enriched
+		}
+	}
+	w.Write(body)
+}
+
+// enrichModelList adds the local capabilities (capabilities.json or
+// CAPABILITIES_FILE) of each known model to an OpenRouter model list. Fields
+// are kept as raw JSON so the ones the proxy does not know survive unchanged.
+func enrichModelList(body []byte) ([]byte, error) {
+	var list map[string]json.RawMessage
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+	var models []map[string]json.RawMessage
+	if err := json.Unmarshal(list["data"], &models); err != nil {
+		return nil, err
+	}
+
+	for _, model := range models {
+		var id string
+		if err := json.Unmarshal(model["id"], &id); err != nil {
+			continue
+		}
+		capabilities, ok := modelCapabilities[id]
+		if !ok {
+			continue
+		}
+		parameters := []string{}
+		if capabilities.Tools {
+			parameters = append(parameters, "tools", "tool_choice")
+		}
+		if capabilities.JSONMode {
+			parameters = append(parameters, "response_format")
+		}
+		model["context_length"], _ = json.Marshal(capabilities.MaxContext)
+		model["max_output_tokens"], _ = json.Marshal(capabilities.MaxOutput)
+		model["supported_parameters"], _ = json.Marshal(parameters)
+	}
+
+	data, err := json.Marshal(models)
+	if err != nil {
+		return nil, err
+	}
+	list["data"] = data
+	return json.Marshal(list)
 }
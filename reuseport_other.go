@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// reusePortSupported reports whether REUSEPORT can share the listening port
+const reusePortSupported = false
+
+// reusePortControl is never used outside Linux, where the proxy falls back to
+// a normal listener
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
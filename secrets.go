@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// ssmGetter is the part of the SSM client used to read parameters
+type ssmGetter interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// vaultReader is the part of the Vault client used to read secrets
+type vaultReader interface {
+	Read(path string) (*vault.Secret, error)
+}
+
+// Clients of the secret stores, created on first use and replaceable in tests.
+// The AWS client reads the usual AWS_* variables and shared config files, the
+// Vault client VAULT_ADDR and VAULT_TOKEN.
+var (
+	newSSMClient = func(ctx context.Context) (ssmGetter, error) {
+		cfg, err := awsconfig.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return ssm.NewFromConfig(cfg), nil
+	}
+	newVaultClient = func() (vaultReader, error) {
+		client, err := vault.NewClient(vault.DefaultConfig())
+		if err != nil {
+			return nil, err
+		}
+		return client.Logical(), nil
+	}
+)
+
+// secretTimeout bounds the fetch of a secret at startup
+const secretTimeout = 10 * time.Second
+
+// resolveSecret returns the secret a config value refers to:
+// ssm:/path/to/param reads an SSM parameter (decrypted) and
+// vault:secret/data/proxy#api_key reads a field of a Vault secret. Any other
+// value is returned as is.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "ssm:"):
+		return fetchSSMParameter(strings.TrimPrefix(value, "ssm:"))
+	case strings.HasPrefix(value, "vault:"):
+		return fetchVaultSecret(strings.TrimPrefix(value, "vault:"))
+	}
+	return value, nil
+}
+
+func fetchSSMParameter(name string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+
+	client, err := newSSMClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("loading AWS config: %w", err)
+	}
+	out, err := client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("reading SSM parameter %s: %w", name, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return "", fmt.Errorf("SSM parameter %s has no value", name)
+	}
+	return *out.Parameter.Value, nil
+}
+
+// fetchVaultSecret reads ref, a secret path and field separated by #. KV
+// version 2 secrets nest their fields under "data".
+func fetchVaultSecret(ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("Vault reference %q must have the form path#field", ref)
+	}
+
+	client, err := newVaultClient()
+	if err != nil {
+		return "", fmt.Errorf("creating Vault client: %w", err)
+	}
+	secret, err := client.Read(path)
+	if err != nil {
+		return "", fmt.Errorf("reading Vault secret %s: %w", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", fmt.Errorf("Vault secret %s not found", path)
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no string field %s", path, field)
+	}
+	return value, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// numericSetting is the accepted range of a numeric environment variable
+type numericSetting struct {
+	name     string
+	min, max float64
+}
+
+// numericSettings lists the numeric variables checked by -validate. A max
+// of 0 means no upper bound.
+var numericSettings = []numericSetting{
+	{"MAX_CONCURRENT_REQUESTS", 1, 0},
+	{"UPSTREAM_MAX_RETRIES", 0, 10},
+	{"RETRY_AFTER_CAP_SECONDS", 0, 0},
+	{"MODEL_LIST_CACHE_TTL", 0, 0},
+	{"MODELS_CACHE_TTL", 0, 0},
+	{"CAPABILITY_REFRESH_INTERVAL", 1, 0},
+	{"HEALTH_CACHE_TTL", 0, 0},
+	{"JOB_TTL_SECONDS", 1, 0},
+	{"QUEUE_DEPTH", 1, 0},
+	{"QUEUE_WORKERS", 1, 0},
+	{"SESSION_TTL_MINUTES", 1, 0},
+	{"SESSION_MAX_TOKENS", 1, 0},
+	{"LARGE_RESPONSE_THRESHOLD", 1, 0},
+	{"BUFFER_SMALL_THRESHOLD", 1, 0},
+	{"BUFFER_LARGE_INITIAL_SIZE", 1, 0},
+	{"HTTP1_MAX_IDLE_CONNS", 0, 0},
+	{"HTTP1_MAX_IDLE_CONNS_PER_HOST", 0, 0},
+	{"HTTP2_MAX_READ_FRAME_SIZE", 0, 16777215},
+	{"AUDIT_LOG_MAX_SIZE_MB", 1, 0},
+	{"AUDIT_LOG_MAX_AGE_DAYS", 0, 0},
+	{"PROVIDER_HEALTH_INTERVAL", 1, 0},
+	{"LATENCY_PROBE_INTERVAL_SECONDS", 1, 0},
+	{"INVALID_CHUNK_THRESHOLD", 0, 0},
+	{"PROVIDER_OUTAGE_THRESHOLD", 0, 1},
+	{"RATE_LIMIT_RPS", 0, 0},
+	{"BATCH_CONCURRENCY", 1, 0},
+	{"MAX_TOOL_ROUNDS", 1, 0},
+	{"LATENCY_WINDOW_SIZE", 1, 0},
+	{"PROGRESS_INTERVAL_TOKENS", 0, 0},
+	{"CONFIG_HISTORY_SIZE", 1, 0},
+	{"SLOW_REQUEST_THRESHOLD_MS", 0, 0},
+	{"MAX_MESSAGES", 0, 0},
+	{"COST_BUDGET_USD", 0, 0},
+	{"COST_ALERT_THRESHOLD_PERCENT", 0, 100},
+}
+
+// durationSettings lists the Go duration variables checked by -validate
+var durationSettings = []string{"BENCHMARK_TIMEOUT", "BATCH_TIMEOUT", "STREAM_CHUNK_TIMEOUT", "HTTP1_IDLE_CONN_TIMEOUT", "MOCK_STREAM_DELAY", "RETRY_BASE_DELAY", "RETRY_MAX_DELAY", "IDEMPOTENCY_TTL", "DEDUPLICATION_WAIT_TIMEOUT"}
+
+// validateRequested reports whether the binary was started with -validate.
+// init loads the configuration before main parses flags, so the arguments
+// are checked directly.
+func validateRequested() bool {
+	for _, arg := range os.Args[1:] {
+		if arg == "-validate" || arg == "--validate" {
+			return true
+		}
+	}
+	return false
+}
+
+// runValidate checks the configuration, prints the errors or a summary of
+// the loaded config, and returns the process exit code
+func runValidate() int {
+	loadDotEnv()
+
+	errs := validateConfig()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "%d configuration error(s)\n", len(errs))
+		return 1
+	}
+
+	model := resolveAlias(os.Getenv("OPENROUTER_MODEL"), modelAliases)
+	if model == "" {
+		model = openRouterModel
+	}
+	_, path, _ := readProxyFile()
+	if path == "" {
+		path = "none"
+	}
+	fmt.Printf("Configuration is valid\n")
+	fmt.Printf("  model:           %s\n", model)
+	fmt.Printf("  weighted models: %s\n", valueOrNone(os.Getenv("OPENROUTER_MODELS")))
+	fmt.Printf("  fallback models: %s\n", valueOrNone(os.Getenv("OPENROUTER_FALLBACK_MODELS")))
+	fmt.Printf("  api key:         %s\n", maskAPIKey(os.Getenv("OPENROUTER_API_KEY")))
+	fmt.Printf("  config file:     %s\n", path)
+	fmt.Printf("  mock mode:       %t\n", os.Getenv("MOCK_MODE") == "true")
+	return 0
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+// validateConfig checks the configuration read by loadConfig and returns
+// every problem found instead of exiting on the first one. CORS origins are
+// not configurable (the proxy always answers "*"), so there is nothing to
+// check for them.
+func validateConfig() []error {
+	var errs []error
+
+	apiKey, err := resolveSecret(os.Getenv("OPENROUTER_API_KEY"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("OPENROUTER_API_KEY: %v", err))
+	} else if os.Getenv("MOCK_MODE") != "true" {
+		if !strings.HasPrefix(apiKey, "sk-or-") {
+			errs = append(errs, fmt.Errorf("OPENROUTER_API_KEY must start with 'sk-or-'"))
+		} else if len(apiKey) < 32 {
+			errs = append(errs, fmt.Errorf("OPENROUTER_API_KEY seems too short to be valid"))
+		}
+	}
+
+	modelAliases = make(map[string]string)
+	for alias, model := range parseKeyValues(os.Getenv("MODEL_ALIASES")) {
+		modelAliases[normalizeModelID(alias)] = model
+	}
+	if model := resolveAlias(os.Getenv("OPENROUTER_MODEL"), modelAliases); model != "" && !strings.Contains(model, "/") {
+		errs = append(errs, fmt.Errorf("OPENROUTER_MODEL %q must contain a provider prefix (e.g. openai/gpt-4o)", model))
+	}
+	for _, model := range splitList(os.Getenv("OPENROUTER_FALLBACK_MODELS")) {
+		if !strings.Contains(resolveAlias(model, modelAliases), "/") {
+			errs = append(errs, fmt.Errorf("OPENROUTER_FALLBACK_MODELS entry %q must contain a provider prefix", model))
+		}
+	}
+	for _, model := range splitList(os.Getenv("LATENCY_ROUTING_MODELS")) {
+		if !strings.Contains(resolveAlias(model, modelAliases), "/") {
+			errs = append(errs, fmt.Errorf("LATENCY_ROUTING_MODELS entry %q must contain a provider prefix", model))
+		}
+	}
+	if value := os.Getenv("OPENROUTER_PROVIDER_PREFERENCES"); value != "" {
+		var preferences ProviderPreferences
+		if err := json.Unmarshal([]byte(value), &preferences); err != nil {
+			errs = append(errs, fmt.Errorf("OPENROUTER_PROVIDER_PREFERENCES: %v", err))
+		}
+	}
+	if _, err := parseBuiltinTools(os.Getenv("BUILTIN_TOOLS")); err != nil {
+		errs = append(errs, fmt.Errorf("BUILTIN_TOOLS: %v", err))
+	}
+	if value := os.Getenv("OPENROUTER_MODELS"); value != "" {
+		if _, err := newWeightedSelector(value); err != nil {
+			errs = append(errs, fmt.Errorf("OPENROUTER_MODELS: %v", err))
+		}
+	}
+
+	for key, value := range parseKeyValues(os.Getenv("KEY_RATE_LIMITS")) {
+		if rpm, err := strconv.Atoi(value); err != nil || rpm <= 0 {
+			errs = append(errs, fmt.Errorf("KEY_RATE_LIMITS entry for key %s must be a positive integer, got %q", maskAPIKey(key), value))
+		}
+	}
+	for model, value := range parseKeyValues(os.Getenv("MODEL_PRICES")) {
+		if _, ok := parseModelPrice(value); !ok {
+			errs = append(errs, fmt.Errorf("MODEL_PRICES entry for model %s must be two prices such as 2.5,10, got %q", model, value))
+		}
+	}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if budgetEnvPattern.MatchString(name) {
+			if limit, err := strconv.ParseInt(value, 10, 64); err != nil || limit <= 0 {
+				errs = append(errs, fmt.Errorf("%s must be a positive integer, got %q", name, value))
+			}
+		}
+	}
+
+	for _, setting := range numericSettings {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		switch {
+		case err != nil:
+			errs = append(errs, fmt.Errorf("%s must be a number, got %q", setting.name, value))
+		case n < setting.min:
+			errs = append(errs, fmt.Errorf("%s must be at least %v, got %v", setting.name, setting.min, n))
+		case setting.max > 0 && n > setting.max:
+			errs = append(errs, fmt.Errorf("%s must be at most %v, got %v", setting.name, setting.max, n))
+		}
+	}
+	for _, name := range durationSettings {
+		if value := os.Getenv(name); value != "" {
+			if d, err := time.ParseDuration(strings.TrimSpace(value)); err != nil || d < 0 {
+				errs = append(errs, fmt.Errorf("%s must be a positive duration such as 30s, got %q", name, value))
+			}
+		}
+	}
+
+	if strategy := os.Getenv("TRUNCATE_STRATEGY"); !validTruncateStrategy(strategy) {
+		errs = append(errs, fmt.Errorf("TRUNCATE_STRATEGY: unknown strategy %q (use oldest_first or summarize)", strategy))
+	}
+	if route := os.Getenv("OPENROUTER_ROUTE"); !validRoute(route) {
+		errs = append(errs, fmt.Errorf("OPENROUTER_ROUTE: unknown route %q (use fallback)", route))
+	}
+	if _, err := newRetryStrategy(os.Getenv("RETRY_STRATEGY"), 0, 0); err != nil {
+		errs = append(errs, fmt.Errorf("RETRY_STRATEGY: %v", err))
+	}
+	switch exporter := os.Getenv("OTEL_METRICS_EXPORTER"); exporter {
+	case "", "none", "otlp", "prometheus":
+	default:
+		errs = append(errs, fmt.Errorf("OTEL_METRICS_EXPORTER must be otlp or prometheus, got %q", exporter))
+	}
+
+	if text := os.Getenv("WEBHOOK_TEMPLATE"); text != "" {
+		if _, err := template.New("webhook").Parse(text); err != nil {
+			errs = append(errs, fmt.Errorf("WEBHOOK_TEMPLATE: %v", err))
+		}
+	}
+
+	fileConfig, path, err := readProxyFile()
+	if err != nil {
+		return append(errs, err)
+	}
+	for _, rule := range fileConfig.RoutingRules {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			errs = append(errs, fmt.Errorf("%s: routing rule pattern %q: %v", path, rule.Pattern, err))
+		}
+		if !strings.Contains(resolveAlias(rule.Model, modelAliases), "/") {
+			errs = append(errs, fmt.Errorf("%s: routing rule model %q must contain a provider prefix", path, rule.Model))
+		}
+	}
+	for name, named := range fileConfig.NamedConfigs {
+		if !strings.Contains(resolveAlias(named.Model, modelAliases), "/") {
+			errs = append(errs, fmt.Errorf("%s: model %q of named config %s must contain a provider prefix", path, named.Model, name))
+		}
+		for _, model := range named.FallbackModels {
+			if !strings.Contains(resolveAlias(model, modelAliases), "/") {
+				errs = append(errs, fmt.Errorf("%s: fallback model %q of named config %s must contain a provider prefix", path, model, name))
+			}
+		}
+	}
+	for model, deprecation := range fileConfig.DeprecatedModels {
+		if deprecation.Replacement != "" && !strings.Contains(deprecation.Replacement, "/") {
+			errs = append(errs, fmt.Errorf("%s: replacement %q of deprecated model %s must contain a provider prefix", path, deprecation.Replacement, model))
+		}
+	}
+	return errs
+}